@@ -2,16 +2,21 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/larryhou/gocache/server"
 	"hash"
 	"io"
+	"io/ioutil"
+	"math"
 	rand2 "math/rand"
 	"net"
+	"time"
 )
 
 type Engine struct {
@@ -20,10 +25,16 @@ type Engine struct {
 	Verify  bool
 	Rand    *rand2.Rand
 	Version string
+	Secret  string
+	Compress bool
 	c       *server.Stream
 	b       [32 << 10]byte
+	features uint32
 }
 
+// compressed puts are buffered in memory, larger ones are sent as is
+const compressLimit = 16 << 20
+
 func (e *Engine) Close() error {
 	if e.c != nil {
 		return e.c.Close()
@@ -36,12 +47,35 @@ func (e *Engine) Connect() error {
 	if err != nil {return err}
 	e.c = &server.Stream{Rwp: c}
 	buf := e.b[:]
-	secret := "larryhou"
+	secret := e.Secret
+	if secret == "" {secret = "larryhou"}
 	if err := e.c.WriteString(buf, secret); err != nil {return err}
 	if err := e.c.WriteString(buf, e.Version); err != nil {return err}
 	if ver, err := e.c.ReadString(buf); err != nil {return err} else {
 		if ver != e.Version {return fmt.Errorf("version not match: %s != %s", ver, e.Version)}
 	}
+	features := server.FeaturePutAck | server.FeatureJobs
+	if e.Compress {features |= server.FeatureGzip}
+	return e.negotiate(features)
+}
+
+// ErrReadOnly is returned by Put when server storage is out of space
+var ErrReadOnly = errors.New("server read-only")
+
+// ErrDenied is returned by Put when server does not accept puts with secret of engine
+var ErrDenied = errors.New("put denied")
+
+// ErrCleanBusy is returned by Clean when another clean pass is running on server
+var ErrCleanBusy = errors.New("clean in progress")
+
+func (e *Engine) negotiate(features uint32) error {
+	b := e.b[:]
+	b[0] = 'n'
+	binary.BigEndian.PutUint32(b[1:], features)
+	if err := e.c.Write(b, 5); err != nil {return err}
+	if err := e.c.Read(b, 5); err != nil {return err}
+	if b[0] != 'n' {return fmt.Errorf("negotiate cmd not match: %c != n", b[0])}
+	e.features = binary.BigEndian.Uint32(b[1:])
 	return nil
 }
 
@@ -64,7 +98,14 @@ func (e *Engine) UGet(id []byte, t int, u string, w io.Writer) error {
 	return e.get(id, t, w)
 }
 
+// UPut asks server to download u into entity in background
 func (e *Engine) UPut(id []byte, t int, u string) error {
+	_, err := e.UPutJob(id, t, u)
+	return err
+}
+
+// UPutJob asks server to download u into entity in background, returning id of the job tracking it, which is 0 when server does not track jobs
+func (e *Engine) UPutJob(id []byte, t int, u string) (uint64, error) {
 	p := 0
 	b := e.b[0:]
 	b[p] = 'u'
@@ -79,7 +120,47 @@ func (e *Engine) UPut(id []byte, t int, u string) error {
 	p += 2
 	copy(b[p:], u)
 	p += len(u)
-	return e.c.Write(b, p)
+	if err := e.c.Write(b, p); err != nil {return 0, err}
+	if e.features & server.FeatureJobs == 0 {return 0, nil}
+	if err := e.c.Read(b, 1+32+4+8); err != nil {return 0, err}
+	if b[0] != 'u' {return 0, fmt.Errorf("uput cmd not match: %c != u", b[0])}
+	if !bytes.Equal(b[1:33], id) {return 0, fmt.Errorf("uput id not match: %s != %s", hex.EncodeToString(b[1:33]), hex.EncodeToString(id))}
+	return binary.BigEndian.Uint64(b[37:]), nil
+}
+
+// Job returns status of uput job
+func (e *Engine) Job(job uint64) (*server.JobStatus, error) {
+	if e.features & server.FeatureJobs == 0 {return nil, errors.New("server does not track jobs")}
+	b := e.b[:]
+	b[0] = 'j'
+	binary.BigEndian.PutUint64(b[1:], job)
+	if err := e.c.Write(b, 9); err != nil {return nil, err}
+	if err := e.c.Read(b, 26); err != nil {return nil, err}
+	if b[0] != 'j' {return nil, fmt.Errorf("job cmd not match: %c != j", b[0])}
+	v := &server.JobStatus{
+		Id:       binary.BigEndian.Uint64(b[1:]),
+		State:    b[9],
+		Size:     int64(binary.BigEndian.Uint64(b[10:])),
+		Received: int64(binary.BigEndian.Uint64(b[18:])),
+	}
+	reason, err := e.c.ReadString(b)
+	if err != nil {return nil, err}
+	v.Reason = reason
+	return v, nil
+}
+
+// Wait polls uput job every interval until it finishes, returning an error when it failed
+func (e *Engine) Wait(job uint64, interval time.Duration) (*server.JobStatus, error) {
+	for {
+		v, err := e.Job(job)
+		if err != nil {return nil, err}
+		switch v.State {
+		case server.JobDone: return v, nil
+		case server.JobFailed: return v, fmt.Errorf("uput job %d failed: %s", job, v.Reason)
+		case server.JobUnknown: return v, fmt.Errorf("uput job %d unknown", job)
+		}
+		time.Sleep(interval)
+	}
 }
 
 func (e *Engine) Get(id []byte, t int, w io.Writer) error {
@@ -99,7 +180,10 @@ func (e *Engine) Get(id []byte, t int, w io.Writer) error {
 func (e *Engine) get(id []byte, t int, w io.Writer) error {
 	b := e.b[:]
 	n := 1 + 32 + 4 + 8
+	if e.features & server.FeatureGzip != 0 {n++}
 	if err := e.c.Read(b, n); err != nil {return err}
+	encoding := server.EncodingIdentity
+	if e.features & server.FeatureGzip != 0 {encoding = b[n-1]}
 	c := b[0]
 	b = b[1:]
 	if !bytes.Equal(b[:32], id) {return fmt.Errorf("get id not match: %s != %s",
@@ -111,6 +195,7 @@ func (e *Engine) get(id []byte, t int, w io.Writer) error {
 	size := int64(binary.BigEndian.Uint64(b))
 	if c == '-' {return nil}
 	if c != '+' {return fmt.Errorf("get cmd not match: %c != +", c)}
+	if encoding == server.EncodingGzip {return e.decode(size, w)}
 
 	read := int64(0)
 	for read < size {
@@ -127,7 +212,29 @@ func (e *Engine) get(id []byte, t int, w io.Writer) error {
 	return nil
 }
 
+func (e *Engine) decode(size int64, w io.Writer) error {
+	body := io.LimitReader(e.c.Rwp, size)
+	defer io.Copy(ioutil.Discard, body)
+	gz, err := gzip.NewReader(body)
+	if err != nil {return err}
+	if _, err := io.CopyBuffer(w, gz, e.b[:]); err != nil {return err}
+	return gz.Close()
+}
+
 func (e *Engine) Put(id []byte, t int, size int64, r io.Reader) error {
+	if e.features & server.FeatureGzip != 0 && size <= compressLimit {
+		var raw, enc bytes.Buffer
+		if _, err := io.CopyN(&raw, r, size); err != nil {return err}
+		gz := gzip.NewWriter(&enc)
+		if _, err := gz.Write(raw.Bytes()); err != nil {return err}
+		if err := gz.Close(); err != nil {return err}
+		if int64(enc.Len()) < size * 9 / 10 {return e.put(id, t, int64(enc.Len()), server.EncodingGzip, size, &enc)}
+		return e.put(id, t, size, server.EncodingIdentity, size, &raw)
+	}
+	return e.put(id, t, size, server.EncodingIdentity, size, r)
+}
+
+func (e *Engine) put(id []byte, t int, size int64, encoding byte, raw int64, r io.Reader) error {
 	p := 0
 	b := e.b[:]
 	b[p] = 'p'
@@ -138,6 +245,12 @@ func (e *Engine) Put(id []byte, t int, size int64, r io.Reader) error {
 	p += 4
 	binary.BigEndian.PutUint64(b[p:], uint64(size))
 	p += 8
+	if e.features & server.FeatureGzip != 0 {
+		b[p] = encoding
+		p++
+		binary.BigEndian.PutUint64(b[p:], uint64(raw))
+		p += 8
+	}
 	if err := e.c.Write(b, p); err != nil {return err}
 	sent := int64(0)
 	for sent < size {
@@ -149,17 +262,92 @@ func (e *Engine) Put(id []byte, t int, size int64, r io.Reader) error {
 			sent += int64(n)
 		}
 	}
-	return nil
+	if e.features & server.FeaturePutAck == 0 {return nil}
+	b = e.b[:]
+	if err := e.c.Read(b, 1+32+4+1); err != nil {return err}
+	if b[0] != 'p' {return fmt.Errorf("put ack cmd not match: %c != p", b[0])}
+	if !bytes.Equal(b[1:33], id) {return fmt.Errorf("put ack id not match: %s != %s", hex.EncodeToString(b[1:33]), hex.EncodeToString(id))}
+	switch b[37] {
+	case '+': return nil
+	case 'r': return ErrReadOnly
+	case 'd': return ErrDenied
+	default: return fmt.Errorf("put failed: %c", b[37])
+	}
 }
 
-func (e *Engine) Clean(days uint16) error {
+func (e *Engine) Clean(dry bool) (*server.CleanReport, error) {
 	p := 0
 	b := e.b[:]
 	b[p] = 'c'
 	p++
-	binary.BigEndian.PutUint16(b[p:], days)
+	b[p] = 0
+	if dry {b[p] |= 1}
+	p++
+	if err := e.c.Write(b, p); err != nil {return nil, err}
+	if err := e.c.Read(b, 1+16); err != nil {return nil, err}
+	if b[0] == 'b' {return nil, ErrCleanBusy}
+	if b[0] != '+' {return nil, fmt.Errorf("clean denied")}
+	b = b[1:]
+	return &server.CleanReport{
+		Namespaces: int(binary.BigEndian.Uint32(b)),
+		Files: int(binary.BigEndian.Uint32(b[4:])),
+		Size: int64(binary.BigEndian.Uint64(b[8:])),
+		DryRun: dry,
+	}, nil
+}
+
+// Export streams a tar of entries in version namespace into w, optionally limited to ids and types
+func (e *Engine) Export(ids [][]byte, types []int, w io.Writer) (*server.ArchiveReport, error) {
+	if len(ids) > math.MaxUint16 || len(types) > math.MaxUint16 {return nil, fmt.Errorf("export filter too large: %d ids %d types", len(ids), len(types))}
+	p := 0
+	b := e.b[:]
+	if n := 1+2+32*len(ids)+2+4*len(types); n > len(b) {b = make([]byte, n)}
+	b[p] = 'x'
+	p++
+	binary.BigEndian.PutUint16(b[p:], uint16(len(ids)))
 	p += 2
-	return e.c.Write(b, p)
+	for _, id := range ids {
+		copy(b[p:], id)
+		p += 32
+	}
+	binary.BigEndian.PutUint16(b[p:], uint16(len(types)))
+	p += 2
+	for _, t := range types {
+		binary.BigEndian.PutUint32(b[p:], uint32(t))
+		p += 4
+	}
+	if err := e.c.Write(b, p); err != nil {return nil, err}
+	if err := e.c.Read(b, 1); err != nil {return nil, err}
+	if b[0] != '+' {return nil, fmt.Errorf("export denied")}
+	if _, err := io.CopyBuffer(w, &server.ChunkReader{S: e.c}, make([]byte, 64<<10)); err != nil {return nil, err}
+	b = e.b[:]
+	if err := e.c.Read(b, 1+16); err != nil {return nil, err}
+	if b[0] != '+' {return nil, fmt.Errorf("export cmd not match: %c != +", b[0])}
+	b = b[1:]
+	return &server.ArchiveReport{
+		Files: int(binary.BigEndian.Uint32(b)),
+		Skipped: int(binary.BigEndian.Uint32(b[4:])),
+		Size: int64(binary.BigEndian.Uint64(b[8:])),
+	}, nil
+}
+
+// Import uploads a tar made by Export into version namespace, entries are verified by server before being stored
+func (e *Engine) Import(r io.Reader) (*server.ArchiveReport, error) {
+	b := e.b[:]
+	b[0] = 'i'
+	if err := e.c.Write(b, 1); err != nil {return nil, err}
+	w := &server.ChunkWriter{S: e.c}
+	if _, err := io.CopyBuffer(w, r, make([]byte, 64<<10)); err != nil {return nil, err}
+	if err := w.Close(); err != nil {return nil, err}
+	if err := e.c.Read(b, 1+20); err != nil {return nil, err}
+	if b[0] != '+' {return nil, fmt.Errorf("import failed")}
+	b = b[1:]
+	return &server.ArchiveReport{
+		Files: int(binary.BigEndian.Uint32(b)),
+		Skipped: int(binary.BigEndian.Uint32(b[4:])),
+		Rejected: int(binary.BigEndian.Uint32(b[8:])),
+		Size: int64(binary.BigEndian.Uint64(b[12:])),
+	}, nil
 }
 
 func (e *Engine) Pump(size int64, w io.Writer) error {
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "flag"
+    "github.com/larryhou/gocache/client"
+    "log"
+    rand2 "math/rand"
+    "sync/atomic"
+    "time"
+)
+
+var bench struct {
+    addr     string
+    port     int
+    command  string
+    size     int64
+    conns    int
+    duration time.Duration
+    version  string
+}
+
+func main() {
+    flag.StringVar(&bench.addr, "addr", "127.0.0.1", "server address")
+    flag.IntVar(&bench.port, "port", 9966, "server port")
+    flag.StringVar(&bench.command, "command", "get", "benchmark command: get | put")
+    flag.Int64Var(&bench.size, "size", 64<<20, "entity size in bytes")
+    flag.IntVar(&bench.conns, "conns", 4, "concurrent connections")
+    flag.DurationVar(&bench.duration, "duration", 10*time.Second, "benchmark duration")
+    flag.StringVar(&bench.version, "version", "benchv1.0", "cache version")
+    flag.Parse()
+
+    data := make([]byte, bench.size)
+    rand.Read(data)
+    uuid := make([]byte, 32)
+    rand.Read(uuid)
+    if bench.command == "get" {
+        c := connect()
+        if err := c.Put(uuid, 0, bench.size, bytes.NewReader(data)); err != nil {panic(err)}
+        c.Close()
+    }
+
+    n := int64(0)
+    t := time.Now()
+    for i := 0; i < bench.conns; i++ {
+        go func() {
+            c := connect()
+            defer c.Close()
+            id := make([]byte, 32)
+            for {
+                var err error
+                if bench.command == "get" {
+                    var counter client.Counter
+                    err = c.Get(uuid, 0, &counter)
+                } else {
+                    rand.Read(id)
+                    err = c.Put(id, 0, bench.size, bytes.NewReader(data))
+                }
+                if err != nil {panic(err)}
+                atomic.AddInt64(&n, bench.size)
+            }
+        }()
+    }
+
+    last, ts := int64(0), t
+    for time.Since(t) < bench.duration {
+        time.Sleep(time.Second)
+        v := atomic.LoadInt64(&n)
+        log.Printf("%s %.2fG/s\n", bench.command, float64(v - last) / time.Since(ts).Seconds() / (1<<30))
+        last, ts = v, time.Now()
+    }
+    log.Printf("%s total %.2fG/s over %d connections\n", bench.command, float64(atomic.LoadInt64(&n)) / time.Since(t).Seconds() / (1<<30), bench.conns)
+}
+
+func connect() *client.Engine {
+    c := &client.Engine{Addr: bench.addr, Port: bench.port, Version: bench.version, Rand: rand2.New(rand2.NewSource(time.Now().UnixNano()))}
+    if err := c.Connect(); err != nil {panic(err)}
+    return c
+}
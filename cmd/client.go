@@ -9,6 +9,7 @@ import (
     "os"
     "path"
     "strconv"
+    "strings"
     "time"
 )
 
@@ -16,26 +17,28 @@ func main() {
     s := rand.NewSource(time.Now().UnixNano())
     r := rand.New(s)
 
-    var vars struct{command,path,output string; uuid string; t int; days uint}
+    var vars struct{command,path,output string; uuid string; t int; dry, wait bool; ids,types string}
 
     c := &client.Engine{Rand: r}
-    flag.StringVar(&vars.command, "command", "get", "supported commands: get | put | uget | uput | clean")
-    flag.StringVar(&vars.path, "path", "", "resource path")
+    flag.StringVar(&vars.command, "command", "get", "supported commands: get | put | uget | uput | clean | export | import")
+    flag.StringVar(&vars.path, "path", "", "resource path, or archive path for export and import")
     flag.StringVar(&vars.uuid, "uuid", "", "resource entity uuid")
     flag.StringVar(&c.Addr, "addr", "127.0.0.1", "server address")
     flag.IntVar(&c.Port, "port", 9966, "server port")
     flag.IntVar(&vars.t, "type", 0, "resource type")
     flag.StringVar(&vars.output, "output", ".", "get output directory")
     flag.StringVar(&c.Version, "version", "cliv2.0", "cache version")
-    flag.UintVar(&vars.days, "days", 30, "number of days, used with clean command")
+    flag.StringVar(&c.Secret, "secret", "larryhou", "connect secret pass, clean requires a matching one")
+    flag.BoolVar(&c.Compress, "compress", false, "negotiate gzip encoded transfer")
+    flag.BoolVar(&vars.wait, "wait", false, "wait for uput job to finish")
+    flag.BoolVar(&vars.dry, "dry-run", false, "report what clean would remove without removing")
+    flag.StringVar(&vars.ids, "ids", "", "comma separated uuids to export, all by default")
+    flag.StringVar(&vars.types, "types", "", "comma separated types to export, all by default")
     flag.Parse()
 
     if err := c.Connect(); err != nil {panic(err)}
 
-    uuid := make([]byte, 32)
-    if _, err := hex.Decode(uuid, []byte(vars.uuid)); err != nil {
-        if len(vars.uuid) > len(uuid) { copy(uuid, vars.uuid[:32]) } else { copy(uuid, vars.uuid) }
-    }
+    uuid := parseUuid(vars.uuid)
 
     filename := path.Join(vars.output, hex.EncodeToString(uuid)+"."+strconv.Itoa(vars.t))
 
@@ -60,8 +63,46 @@ func main() {
             if err := c.UGet(uuid, vars.t, vars.path, file); err != nil {panic(err)}
         } else {panic(err)}
     case "uput":
-        if err := c.UPut(uuid, vars.t, vars.path); err != nil {panic(err)}
-    case "clean": c.Clean(uint16(vars.days))
+        job, err := c.UPutJob(uuid, vars.t, vars.path)
+        if err != nil {panic(err)}
+        if vars.wait && job != 0 {
+            v, err := c.Wait(job, 200*time.Millisecond)
+            if err != nil {panic(err)}
+            fmt.Printf("uput job %d done size=%d\n", job, v.Size)
+        } else { fmt.Printf("uput job %d\n", job) }
+    case "clean":
+        if r, err := c.Clean(vars.dry); err != nil {panic(err)} else {
+            fmt.Printf("namespaces=%d files=%d size=%d dry=%v\n", r.Namespaces, r.Files, r.Size, r.DryRun)
+        }
+    case "export":
+        var ids [][]byte
+        var types []int
+        for _, v := range strings.Split(vars.ids, ",") { if v != "" { ids = append(ids, parseUuid(v)) } }
+        for _, v := range strings.Split(vars.types, ",") {
+            if v == "" {continue}
+            if t, err := strconv.Atoi(v); err == nil { types = append(types, t) } else {panic(err)}
+        }
+        if file, err := os.OpenFile(vars.path, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0700); err == nil {
+            defer file.Close()
+            if r, err := c.Export(ids, types, file); err != nil {panic(err)} else {
+                fmt.Printf("files=%d size=%d skipped=%d\n", r.Files, r.Size, r.Skipped)
+            }
+        } else {panic(err)}
+    case "import":
+        if file, err := os.Open(vars.path); err == nil {
+            defer file.Close()
+            if r, err := c.Import(file); err != nil {panic(err)} else {
+                fmt.Printf("files=%d size=%d skipped=%d rejected=%d\n", r.Files, r.Size, r.Skipped, r.Rejected)
+            }
+        } else {panic(err)}
     default: panic(fmt.Sprintf("unknown command: %s", vars.command))
     }
 }
+
+func parseUuid(v string) []byte {
+    uuid := make([]byte, 32)
+    if _, err := hex.Decode(uuid, []byte(v)); err != nil {
+        if len(v) > len(uuid) { copy(uuid, v[:32]) } else { copy(uuid, v) }
+    }
+    return uuid
+}
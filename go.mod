@@ -3,7 +3,6 @@ module github.com/larryhou/gocache
 go 1.15
 
 require (
-	github.com/djherbis/times v1.5.0
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.7.0 // indirect
 	go.uber.org/zap v1.18.1
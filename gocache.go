@@ -4,20 +4,75 @@ import (
     "flag"
     "github.com/larryhou/gocache/server"
     "net/http"
+    "os"
+    "os/signal"
+    "syscall"
     _ "net/http/pprof"
+    "time"
 )
 
 func main() {
     s := server.CacheServer{}
     flag.IntVar(&s.Port,"port", 9966, "server port")
-    flag.StringVar(&s.Path, "path", "cache", "cache storage path")
+    flag.StringVar(&s.Path, "path", "cache", "comma separated cache storage paths, each optionally suffixed with :weight")
     flag.IntVar(&s.LogLevel, "log-level", 0, "log level debug=-1 info=0 warn=1 error=2 dpanic=3 panic=4 fatal=5")
-    flag.IntVar(&s.CacheCap, "cache-cap", 0, "in-memory cache capacity")
+    flag.Int64Var(&s.CacheCap, "cache-cap", 0, "in-memory cache capacity in bytes, split evenly among 32 shards so files above 1/32 of it are never admitted")
+    flag.Int64Var(&s.CacheMin, "cache-min", 0, "smallest file size in bytes admitted into in-memory cache")
+    flag.Int64Var(&s.CacheMax, "cache-max", 2<<20, "files of this size in bytes or larger are never admitted into in-memory cache")
+    flag.IntVar(&s.CacheHits, "cache-hits", 1, "reads of a file before it is admitted into in-memory cache")
+    flag.BoolVar(&s.CachePut, "cache-on-put", true, "admit files into in-memory cache as soon as they are put")
+    flag.Var(&s.CacheRules, "cache-rule", "repeatable per type admission rule overriding cache limits, e.g. '1:max=512k,hits=2,put=false'")
+    flag.Int64Var(&s.MemLimit, "mem-limit", 0, "process memory limit in bytes that in-memory cache budget adapts to, -1 reads cgroup limit, 0 disables it")
+    flag.Float64Var(&s.MemHigh, "mem-high", 0.8, "fraction of mem-limit that heap usage is kept below by shrinking in-memory cache")
+    flag.DurationVar(&s.WarmInterval, "warm-interval", 5*time.Minute, "interval of persisting hot keys of in-memory cache for warm-up after restart, 0 only persists on shutdown")
+    flag.Int64Var(&s.WarmRate, "warm-rate", 16<<20, "read rate in bytes per second of preloading hot keys after restart, 0 is unlimited")
+    flag.BoolVar(&s.ZeroCopy, "zero-copy", true, "serve gets with sendfile and receive puts straight into files when content needs no processing")
+    flag.DurationVar(&s.PutWait, "put-wait", 0, "how long a get of an entry being put waits for it instead of missing, 0 disables it")
+    flag.BoolVar(&s.PutStream, "put-stream", false, "stream entries being put to waiting gets as bytes arrive rather than after commit, except those compressed by server")
+    flag.StringVar(&s.Parent, "parent", "", "parent gocache server address host:port that local misses are read through from")
+    flag.StringVar(&s.ParentSecret, "parent-secret", "larryhou", "connect secret pass of parent server")
+    flag.BoolVar(&s.ParentPut, "parent-put", false, "forward puts to parent server after they are stored locally")
+    flag.DurationVar(&s.ParentTimeout, "parent-timeout", 5*time.Second, "timeout of connecting and each read or write of parent server, a stalled parent degrades to a miss")
+    flag.DurationVar(&s.FetchTimeout, "fetch-timeout", 10*time.Second, "timeout of connecting, response header and stalled body reads of url fills")
+    flag.IntVar(&s.FetchRetries, "fetch-retries", 2, "retries with backoff of url fills failing with network errors, 5xx or 429")
+    flag.Int64Var(&s.FetchMax, "fetch-max", 4<<30, "largest body in bytes of url fills, 0 is unlimited")
+    flag.Var(&s.FetchAllow, "fetch-allow", "repeatable [scheme://]host-pattern that url fills are restricted to, e.g. 'https://*.example.com', any http(s) url when not given, gocache and s3 urls need a rule of their scheme, loopback and private addresses are only fetched from hosts named exactly")
+    flag.StringVar(&s.FetchCredentials, "fetch-credentials", "", "json file of credentials applied to url fills by host, e.g. [{\"match\": \"https://*.corp.com\", \"bearer\": \"$TOKEN\"}]")
+    flag.StringVar(&s.FetchFiles, "fetch-files", "", "comma separated directories, such as shared mounts, that file:// url fills may read from, file urls are refused when not given")
+    flag.StringVar(&s.S3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "endpoint of S3 compatible object store that s3://bucket/key url fills request with path style")
+    flag.StringVar(&s.S3Region, "s3-region", "us-east-1", "region that s3 url fill requests are signed for")
+    flag.DurationVar(&s.RevalidateAge, "revalidate-age", 0, "age after which gets of url filled entries trigger a conditional upstream request in background, 0 disables it")
+    flag.DurationVar(&s.RevalidateStale, "revalidate-stale", 0, "how long past revalidate-age url gets still serve stale entries before fetching them again, 0 serves them until revalidated")
+    flag.IntVar(&s.JobWorkers, "job-workers", 4, "workers downloading urls of uput jobs")
+    flag.IntVar(&s.JobQueue, "job-queue", 256, "uput jobs waiting for a worker beyond which uputs fail at once")
     flag.StringVar(&s.Secret, "secret", "larryhou", "connect secret pass")
     flag.BoolVar(&s.UnsafeGet, "unsafe-get", true, "allow getting caches from server even when secret does not match")
     flag.BoolVar(&s.DryRun, "dry-run", false, "dry run mode for profiling, don't use it in practise")
+    flag.Var(&s.CleanPolicies, "clean-policy", "repeatable namespace clean policy, e.g. 'cliv*:idle=30d,age=90d,keep=3'")
+    flag.DurationVar(&s.CleanInterval, "clean-interval", time.Hour, "interval of scheduled cleanup")
+    flag.BoolVar(&s.CleanDryRun, "clean-dry-run", false, "only report what scheduled cleanup would remove")
+    flag.DurationVar(&s.TempTTL, "temp-ttl", time.Hour, "age after which unfinished temp files are removed")
+    flag.StringVar(&s.Durability, "durability", server.DurabilityPut, "commit durability: none | put (fsync every put) | batch (group commit)")
+    flag.DurationVar(&s.GroupCommit, "group-commit", 10*time.Millisecond, "group commit window used with -durability batch")
+    flag.BoolVar(&s.Compress, "compress", false, "store compressible entries gzip encoded")
+    flag.IntVar(&s.CompressLevel, "compress-level", 1, "gzip level of at-rest compression")
+    flag.StringVar(&s.ColdPath, "cold-path", "", "comma separated cold tier storage paths, each optionally suffixed with :weight")
+    flag.DurationVar(&s.MigrateAfter, "migrate-after", 7*24*time.Hour, "idle time after which entries move from hot tier to cold tier")
+    flag.DurationVar(&s.MigrateInterval, "migrate-interval", 10*time.Minute, "interval of hot to cold tier migration")
+    flag.Int64Var(&s.MinFree, "min-free", 1<<30, "free bytes per storage root below which it turns read-only and evicts, 0 disables it")
+    flag.Int64Var(&s.ResumeFree, "resume-free", 0, "free bytes at which a read-only root accepts puts again, defaults to twice min-free")
+    flag.Int64Var(&s.ScrubRate, "scrub-rate", 32<<20, "integrity scrubber read rate in bytes per second, 0 disables it")
+    flag.DurationVar(&s.ScrubInterval, "scrub-interval", time.Hour, "pause between integrity scrubber passes")
+    flag.DurationVar(&s.JanitorInterval, "janitor-interval", 10*time.Minute, "interval of temp file and empty directory collection")
     flag.Parse()
 
     go http.ListenAndServe(":9999", nil)
+    go func() {
+        c := make(chan os.Signal, 1)
+        signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+        <-c
+        s.Close()
+        os.Exit(0)
+    }()
     if err := s.Listen(); err != nil { panic(err) }
 }
@@ -0,0 +1,117 @@
+package server
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+const (
+    admitMin = 1 << iota
+    admitMax
+    admitHits
+    admitPut
+)
+
+// AdmissionRule decides which files of Type enter memory cache, fields not given in rule inherit server wide limits.
+// Files are admitted when Min <= size < Max, on their Hits-th read, or right when they are put if Put is set.
+type AdmissionRule struct {
+    Type int
+    Min  int64
+    Max  int64
+    Hits int
+    Put  bool
+    set  int
+}
+
+func (a *AdmissionRule) String() string {
+    var rules []string
+    if a.set & admitMin != 0 { rules = append(rules, "min="+strconv.FormatInt(a.Min, 10)) }
+    if a.set & admitMax != 0 { rules = append(rules, "max="+strconv.FormatInt(a.Max, 10)) }
+    if a.set & admitHits != 0 { rules = append(rules, "hits="+strconv.Itoa(a.Hits)) }
+    if a.set & admitPut != 0 { rules = append(rules, "put="+strconv.FormatBool(a.Put)) }
+    return strconv.Itoa(a.Type) + ":" + strings.Join(rules, ",")
+}
+
+// ParseAdmissionRule parses rules formatted as type:min=0,max=512k,hits=2,put=false
+func ParseAdmissionRule(v string) (*AdmissionRule, error) {
+    i := strings.Index(v, ":")
+    if i <= 0 {return nil, fmt.Errorf("admission rule without type: %s", v)}
+    t, err := strconv.Atoi(v[:i])
+    if err != nil {return nil, err}
+    a := &AdmissionRule{Type: t}
+    for _, rule := range strings.Split(v[i+1:], ",") {
+        kv := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+        if len(kv) != 2 {return nil, fmt.Errorf("admission rule malformed: %s", rule)}
+        switch kv[0] {
+        case "min", "max":
+            n, err := parseBytes(kv[1])
+            if err != nil {return nil, err}
+            if kv[0] == "min" {a.Min, a.set = n, a.set | admitMin} else {a.Max, a.set = n, a.set | admitMax}
+        case "hits":
+            n, err := strconv.Atoi(kv[1])
+            if err != nil {return nil, err}
+            a.Hits, a.set = n, a.set | admitHits
+        case "put":
+            b, err := strconv.ParseBool(kv[1])
+            if err != nil {return nil, err}
+            a.Put, a.set = b, a.set | admitPut
+        default: return nil, fmt.Errorf("admission rule unsupported: %s", kv[0])
+        }
+    }
+    return a, nil
+}
+
+// parseBytes parses sizes with an optional k, m or g suffix
+func parseBytes(v string) (int64, error) {
+    unit := int64(1)
+    switch {
+    case strings.HasSuffix(v, "k"): unit = 1 << 10
+    case strings.HasSuffix(v, "m"): unit = 1 << 20
+    case strings.HasSuffix(v, "g"): unit = 1 << 30
+    }
+    if unit > 1 { v = v[:len(v)-1] }
+    n, err := strconv.ParseInt(v, 10, 64)
+    if err != nil {return 0, err}
+    return n * unit, nil
+}
+
+// AdmissionRules implements flag.Value so that per type rules can be repeated on command line
+type AdmissionRules []*AdmissionRule
+
+func (c *AdmissionRules) String() string {
+    var v []string
+    for _, a := range *c { v = append(v, a.String()) }
+    return strings.Join(v, " ")
+}
+
+func (c *AdmissionRules) Set(v string) error {
+    a, err := ParseAdmissionRule(v)
+    if err != nil {return err}
+    *c = append(*c, a)
+    return nil
+}
+
+// admission returns rule of type t with unset fields filled by server wide limits
+func (s *CacheServer) admission(t int) AdmissionRule {
+    a := AdmissionRule{Type: t, Min: s.CacheMin, Max: s.CacheMax, Hits: s.CacheHits, Put: s.CachePut}
+    for _, r := range s.CacheRules {
+        if r.Type != t {continue}
+        if r.set & admitMin != 0 { a.Min = r.Min }
+        if r.set & admitMax != 0 { a.Max = r.Max }
+        if r.set & admitHits != 0 { a.Hits = r.Hits }
+        if r.set & admitPut != 0 { a.Put = r.Put }
+    }
+    return a
+}
+
+// admit reports whether a file of type t is kept in memory, hits counts reads including current one
+func (s *CacheServer) admit(t int, size int64, hits int64, put bool) bool {
+    if !mcache.core.enabled() {return false}
+    a := s.admission(t)
+    ok := size >= a.Min && size < a.Max && mcache.core.fits(size) /* decline before content is buffered */
+    if put { ok = ok && a.Put } else { ok = ok && hits >= int64(a.Hits) }
+    if !ok { atomic.AddInt64(&mcache.core.declined, 1) }
+    return ok
+}
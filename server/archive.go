@@ -0,0 +1,265 @@
+package server
+
+import (
+    "archive/tar"
+    "bufio"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "go.uber.org/zap"
+    "io"
+    "io/ioutil"
+    "math/rand"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// paxMeta is the pax record carrying entry meta in archives, entries without it are described by their names
+const paxMeta = "GOCACHE.meta"
+
+// ArchiveFilter selects entries of a namespace to export, empty sets select everything
+type ArchiveFilter struct {
+    Uuids map[string]bool
+    Types map[int]bool
+}
+
+func (f *ArchiveFilter) match(m *Meta) bool {
+    if f == nil {return true}
+    if len(f.Uuids) > 0 && !f.Uuids[m.Uuid] {return false}
+    if len(f.Types) > 0 && !f.Types[m.Type] {return false}
+    return true
+}
+
+// ArchiveReport summarizes an export or import, skipped entries already existed and rejected ones failed verification
+type ArchiveReport struct {
+    Files    int
+    Size     int64
+    Skipped  int
+    Rejected int
+}
+
+// ChunkWriter frames a stream of unknown length into uint32 sized chunks, closing it writes the empty terminating chunk
+type ChunkWriter struct {
+    S *Stream
+    b [4]byte
+}
+
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+    if len(p) == 0 {return 0, nil}
+    binary.BigEndian.PutUint32(w.b[:], uint32(len(p)))
+    if err := w.S.Write(w.b[:], 4); err != nil {return 0, err}
+    if err := w.S.Write(p, len(p)); err != nil {return 0, err}
+    return len(p), nil
+}
+
+func (w *ChunkWriter) Close() error {
+    binary.BigEndian.PutUint32(w.b[:], 0)
+    return w.S.Write(w.b[:], 4)
+}
+
+// ChunkReader reads a stream framed by ChunkWriter until the terminating chunk
+type ChunkReader struct {
+    S    *Stream
+    b    [4]byte
+    n    int
+    done bool
+}
+
+func (r *ChunkReader) Read(p []byte) (int, error) {
+    if r.done {return 0, io.EOF}
+    if r.n == 0 {
+        if err := r.S.Read(r.b[:], 4); err != nil {return 0, err}
+        r.n = int(binary.BigEndian.Uint32(r.b[:]))
+        if r.n == 0 {
+            r.done = true
+            return 0, io.EOF
+        }
+    }
+    if len(p) > r.n { p = p[:r.n] }
+    n, err := r.S.Rwp.Read(p)
+    r.n -= n
+    if err == io.EOF && r.n > 0 { err = io.ErrUnexpectedEOF }
+    if err == io.EOF { err = nil }
+    return n, err
+}
+
+// export writes entries of version namespace as a tar, each carrying its meta and digest of stored content
+func (s *CacheServer) export(w io.Writer, version string, filter *ArchiveFilter) (*ArchiveReport, error) {
+    ts := time.Now()
+    report := &ArchiveReport{}
+    bw := bufio.NewWriterSize(w, 64<<10)
+    tw := tar.NewWriter(bw)
+    buf := make([]byte, 64<<10)
+    for _, r := range s.roots {
+        for _, m := range r.index.list(version) {
+            if !filter.match(&m) {continue}
+            file, err := s.openEntry(r, &m, buf)
+            if err != nil {
+                logger.Warn("export skip", zap.String("file", r.entry(&m)), zap.Error(err))
+                report.Skipped++
+                continue
+            }
+            err = exportEntry(tw, r, &m, file, buf)
+            file.Close()
+            if err != nil {return report, err}
+            report.Files++
+            report.Size += m.Disk()
+        }
+    }
+    if err := tw.Close(); err != nil {return report, err}
+    if err := bw.Flush(); err != nil {return report, err}
+    logger.Info("export", zap.String("version", version), zap.Int("files", report.Files), zap.Int64("size", report.Size), zap.Int("skipped", report.Skipped), zap.Duration("elapse", time.Since(ts)))
+    return report, nil
+}
+
+// openEntry opens a stored entry for export, digest is computed beforehand for entries that were never hashed
+func (s *CacheServer) openEntry(r *root, m *Meta, buf []byte) (*os.File, error) {
+    file, err := os.Open(r.entry(m))
+    if err != nil {return nil, err}
+    info, err := file.Stat()
+    if err != nil {file.Close();return nil, err}
+    if info.Size() != m.Disk() {
+        file.Close()
+        return nil, fmt.Errorf("size mismatch: %d != %d", info.Size(), m.Disk())
+    }
+    if m.Digest == "" {
+        h := sha256.New()
+        if _, err := io.CopyBuffer(h, file, buf); err != nil {file.Close();return nil, err}
+        m.Digest = hex.EncodeToString(h.Sum(nil))
+        if _, err := file.Seek(0, io.SeekStart); err != nil {file.Close();return nil, err}
+    }
+    return file, nil
+}
+
+func exportEntry(tw *tar.Writer, r *root, m *Meta, file *os.File, buf []byte) error {
+    b, err := json.Marshal(m)
+    if err != nil {return err}
+    header := &tar.Header{
+        Typeflag: tar.TypeReg,
+        Name: strings.TrimPrefix(r.entry(m), r.path + "/"),
+        Size: m.Disk(),
+        Mode: 0600,
+        ModTime: time.Unix(0, m.Created),
+        Format: tar.FormatPAX,
+        PAXRecords: map[string]string{paxMeta: string(b)},
+    }
+    if err := tw.WriteHeader(header); err != nil {return err}
+    _, err = io.CopyBuffer(tw, io.LimitReader(file, m.Disk()), buf)
+    return err
+}
+
+// restore loads entries of a tar into version namespace, verifying size and digest of every one before committing
+func (s *CacheServer) restore(rd io.Reader, version string) (*ArchiveReport, error) {
+    ts := time.Now()
+    report := &ArchiveReport{}
+    tr := tar.NewReader(rd)
+    buf := make([]byte, 64<<10)
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {break}
+        if err != nil {return report, err}
+        if header.Typeflag != tar.TypeReg {continue}
+        m, ok := archiveMeta(header)
+        if !ok {
+            logger.Warn("import skip", zap.String("name", header.Name))
+            report.Rejected++
+            continue
+        }
+        m.Version = version
+        if _, _, exists := s.locate(version, m.Uuid, m.Type); exists {
+            report.Skipped++
+            continue
+        }
+        if broken, err := s.restoreEntry(tr, m, buf); err != nil {
+            if broken {return report, err}
+            logger.Error("import reject", zap.String("name", header.Name), zap.Error(err))
+            report.Rejected++
+            continue
+        }
+        report.Files++
+        report.Size += m.Disk()
+    }
+    logger.Info("import", zap.String("version", version), zap.Int("files", report.Files), zap.Int64("size", report.Size), zap.Int("skipped", report.Skipped), zap.Int("rejected", report.Rejected), zap.Duration("elapse", time.Since(ts)))
+    return report, nil
+}
+
+// restoreEntry saves and commits one archive entry, reporting broken when archive itself can not be read further
+func (s *CacheServer) restoreEntry(tr *tar.Reader, m *Meta, buf []byte) (bool, error) {
+    r := s.place(m.Uuid)
+    if r == nil || s.DryRun {
+        _, err := io.CopyBuffer(ioutil.Discard, tr, buf)
+        return err != nil, fmt.Errorf("no writable root")
+    }
+    var file *os.File
+    failure := r.mktemp()
+    if failure == nil {
+        rand.Read(buf[:32])
+        file, failure = os.OpenFile(path.Join(r.temp, hex.EncodeToString(buf[:32])), os.O_CREATE | os.O_WRONLY, 0700)
+    }
+    h := sha256.New()
+    size := int64(0)
+    for {
+        n, err := tr.Read(buf)
+        if n > 0 && failure == nil {
+            if _, failure = file.Write(buf[:n]); failure == nil { h.Write(buf[:n]) }
+        }
+        size += int64(n)
+        if err == io.EOF {break}
+        if err != nil {
+            if file != nil {file.Close();os.Remove(file.Name())}
+            return true, err
+        }
+    }
+    if failure != nil {
+        if file != nil {file.Close();os.Remove(file.Name())}
+        r.fail(failure)
+        return false, failure
+    }
+    file.Close()
+    digest := hex.EncodeToString(h.Sum(nil))
+    if size != m.Disk() || (m.Digest != "" && digest != m.Digest) {
+        os.Remove(file.Name())
+        return false, fmt.Errorf("verify mismatch: size %d != %d digest %s != %s", size, m.Disk(), digest, m.Digest)
+    }
+    m.Digest = digest
+    if m.Encoding != "" && m.Size == 0 { m.Size = gzipSize(file.Name()) }
+    name := r.entry(m)
+    return false, s.commit(r, file.Name(), name, m)
+}
+
+// archiveMeta reads entry meta from pax record, falling back to storage layout version/uuid[:2]/uuid/type of its name
+func archiveMeta(header *tar.Header) (*Meta, bool) {
+    m := &Meta{}
+    if v, ok := header.PAXRecords[paxMeta]; ok {
+        if err := json.Unmarshal([]byte(v), m); err != nil {return nil, false}
+    } else {
+        parts := strings.Split(path.Clean(header.Name), "/")
+        if len(parts) != 4 {return nil, false}
+        t, err := strconv.Atoi(strings.TrimSuffix(parts[3], gzipSuffix))
+        if err != nil {return nil, false}
+        m.Uuid, m.Type, m.Size = parts[2], t, header.Size
+        m.Created = header.ModTime.UnixNano()
+        if strings.HasSuffix(parts[3], gzipSuffix) {
+            m.Encoding = encodingName(EncodingGzip)
+            m.Stored = header.Size
+            m.Size = 0
+        }
+    }
+    if _, err := hex.DecodeString(m.Uuid); err != nil || len(m.Uuid) != 64 {return nil, false}
+    if m.Encoding != encodingName(encodingOf(m)) {return nil, false} /* only encodings get can serve */
+    if m.Disk() != header.Size {return nil, false}
+    if m.Created == 0 { m.Created = time.Now().UnixNano() }
+    m.Accessed = time.Now().UnixNano()
+    return m, true
+}
+
+// discard drains what is left of a chunked stream so that connection stays usable
+func discard(r *ChunkReader) error {
+    _, err := io.Copy(ioutil.Discard, r)
+    return err
+}
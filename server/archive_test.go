@@ -0,0 +1,19 @@
+package server
+
+import (
+    "archive/tar"
+    "encoding/json"
+    "strings"
+    "testing"
+)
+
+func TestArchiveMetaEncoding(t *testing.T) {
+    for encoding, expect := range map[string]bool{"": true, "gzip": true, "br": false, "GZIP": false, "identity": false} {
+        m := &Meta{Uuid: strings.Repeat("ab", 32), Type: 1, Size: 4, Stored: 4, Encoding: encoding}
+        if encoding == "" { m.Stored = 0 }
+        b, err := json.Marshal(m)
+        if err != nil { t.Fatal(err) }
+        header := &tar.Header{Name: "x", Size: 4, PAXRecords: map[string]string{paxMeta: string(b)}}
+        if _, ok := archiveMeta(header); ok != expect { t.Errorf("encoding %q imported %v", encoding, ok) }
+    }
+}
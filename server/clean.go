@@ -0,0 +1,191 @@
+package server
+
+import (
+    "fmt"
+    "go.uber.org/zap"
+    "io/ioutil"
+    "os"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// CleanPolicy describes how entries in the namespaces matching Pattern expire.
+// Zero values disable the corresponding rule.
+type CleanPolicy struct {
+    Pattern string
+    MaxIdle time.Duration // since last access
+    MaxAge  time.Duration // since creation
+    Keep    int           // number of most recent matching namespaces to keep
+}
+
+func (p *CleanPolicy) String() string {
+    var rules []string
+    if p.MaxIdle > 0 { rules = append(rules, "idle="+p.MaxIdle.String()) }
+    if p.MaxAge > 0 { rules = append(rules, "age="+p.MaxAge.String()) }
+    if p.Keep > 0 { rules = append(rules, "keep="+strconv.Itoa(p.Keep)) }
+    return p.Pattern + ":" + strings.Join(rules, ",")
+}
+
+// ParseCleanPolicy parses policies formatted as pattern:idle=30d,age=90d,keep=3
+func ParseCleanPolicy(v string) (*CleanPolicy, error) {
+    i := strings.LastIndex(v, ":")
+    if i <= 0 {return nil, fmt.Errorf("clean policy without pattern: %s", v)}
+    p := &CleanPolicy{Pattern: v[:i]}
+    if _, err := path.Match(p.Pattern, ""); err != nil {return nil, err}
+    for _, rule := range strings.Split(v[i+1:], ",") {
+        kv := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+        if len(kv) != 2 {return nil, fmt.Errorf("clean rule malformed: %s", rule)}
+        switch kv[0] {
+        case "idle", "age":
+            d, err := parseDays(kv[1])
+            if err != nil {return nil, err}
+            if kv[0] == "idle" {p.MaxIdle = d} else {p.MaxAge = d}
+        case "keep":
+            n, err := strconv.Atoi(kv[1])
+            if err != nil {return nil, err}
+            p.Keep = n
+        default: return nil, fmt.Errorf("clean rule unsupported: %s", kv[0])
+        }
+    }
+    return p, nil
+}
+
+func parseDays(v string) (time.Duration, error) {
+    if strings.HasSuffix(v, "d") {
+        n, err := strconv.Atoi(strings.TrimSuffix(v, "d"))
+        if err != nil {return 0, err}
+        return time.Duration(n) * 24 * time.Hour, nil
+    }
+    return time.ParseDuration(v)
+}
+
+// CleanPolicies implements flag.Value so that policies can be repeated on command line
+type CleanPolicies []*CleanPolicy
+
+func (c *CleanPolicies) String() string {
+    var v []string
+    for _, p := range *c { v = append(v, p.String()) }
+    return strings.Join(v, " ")
+}
+
+func (c *CleanPolicies) Set(v string) error {
+    p, err := ParseCleanPolicy(v)
+    if err != nil {return err}
+    *c = append(*c, p)
+    return nil
+}
+
+func (c CleanPolicies) match(namespace string) *CleanPolicy {
+    for _, p := range c {
+        if ok, _ := path.Match(p.Pattern, namespace); ok {return p}
+    }
+    return nil
+}
+
+// CleanReport summarizes what a cleanup pass removed, or would remove in dry-run mode
+type CleanReport struct {
+    Namespaces int
+    Files      int
+    Size       int64
+    DryRun     bool
+}
+
+func (s *CacheServer) schedule() {
+    if s.CleanInterval <= 0 || len(s.CleanPolicies) == 0 {return}
+    s.every(s.CleanInterval, func() { s.clean(s.CleanDryRun) })
+}
+
+// clean applies policies to all namespaces, it returns nil when another pass is in progress
+func (s *CacheServer) clean(dry bool) *CleanReport {
+    if !atomic.CompareAndSwapInt32(&s.cleaning, 0, 1) {return nil}
+    defer atomic.StoreInt32(&s.cleaning, 0)
+
+    ts := time.Now()
+    report := &CleanReport{DryRun: dry}
+    logger.Info("clean", zap.String("path", s.Path), zap.Bool("dry", dry))
+    stats := s.namespaces()
+    for _, r := range s.roots {
+        list, err := ioutil.ReadDir(r.path)
+        if err != nil {
+            logger.Error("clean", zap.String("root", r.path), zap.Error(err))
+            continue
+        }
+        for _, info := range list {
+            if !info.IsDir() || r.reserved(path.Join(r.path, info.Name())) {continue}
+            if _, ok := stats[info.Name()]; !ok { stats[info.Name()] = &Namespace{Version: info.Name(), Accessed: info.ModTime().UnixNano()} }
+        }
+    }
+    var namespaces []*Namespace
+    for _, n := range stats { namespaces = append(namespaces, n) }
+    sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Accessed > namespaces[j].Accessed })
+
+    kept := map[*CleanPolicy]int{}
+    for _, n := range namespaces {
+        if s.stopping() {break}
+        p := s.CleanPolicies.match(n.Version)
+        if p == nil || !namespace(n.Version) {continue}
+        if p.Keep > 0 {
+            if kept[p] >= p.Keep {
+                report.Namespaces++
+                for _, r := range s.roots { s.purge(r, n.Version, report) }
+                continue
+            }
+            kept[p]++
+        }
+        if p.MaxIdle > 0 || p.MaxAge > 0 {
+            for _, r := range s.roots { s.expire(r, n.Version, p, ts, report) }
+        }
+    }
+    logger.Info("clean done", zap.Int("namespaces", report.Namespaces), zap.Int("files", report.Files), zap.Int64("size", report.Size), zap.Bool("dry", dry), zap.Duration("elapse", time.Since(ts)))
+    return report
+}
+
+// purge removes a whole namespace of root that exceeds its policy's keep count, its indexed files first and then what is left of its directory
+func (s *CacheServer) purge(r *root, version string, report *CleanReport) {
+    dir := path.Join(r.path, version)
+    if path.Dir(dir) != path.Clean(r.path) || r.reserved(dir) { /* never anything but a directory right under root */
+        logger.Error("clean namespace refused", zap.String("root", r.path), zap.String("ver", version))
+        return
+    }
+    entries := r.index.list(version)
+    size := int64(0)
+    for _, m := range entries { size += m.Disk() }
+    report.Files += len(entries)
+    report.Size += size
+    logger.Info("clean namespace", zap.String("dir", dir), zap.Int("files", len(entries)), zap.Int64("size", size), zap.Bool("dry", report.DryRun))
+    if report.DryRun {return}
+    for _, m := range entries {
+        name := r.entry(&m)
+        if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+            logger.Error("clean namespace", zap.String("name", name), zap.Error(err))
+            continue
+        }
+        r.index.remove(&m)
+        mcache.core.drop(m.Key())
+    }
+    if err := os.RemoveAll(dir); err != nil { logger.Error("clean namespace", zap.String("dir", dir), zap.Error(err)) }
+}
+
+func (s *CacheServer) expire(r *root, version string, p *CleanPolicy, ts time.Time, report *CleanReport) {
+    for _, m := range r.index.list(version) {
+        idle := p.MaxIdle > 0 && ts.Sub(time.Unix(0, m.Accessed)) > p.MaxIdle
+        aged := p.MaxAge > 0 && ts.Sub(time.Unix(0, m.Created)) > p.MaxAge
+        if !idle && !aged {continue}
+        name := r.entry(&m)
+        if !report.DryRun {
+            if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+                logger.Error("clean", zap.String("name", name), zap.Error(err))
+                continue
+            }
+            r.index.remove(&m)
+            mcache.core.drop(m.Key())
+        }
+        report.Files++
+        report.Size += m.Disk()
+        logger.Info("clean", zap.String("name", name), zap.Int64("size", m.Disk()), zap.Bool("idle", idle), zap.Bool("aged", aged), zap.Bool("dry", report.DryRun))
+    }
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+    "io/ioutil"
+    "os"
+    "path"
+    "strings"
+    "testing"
+)
+
+func TestNamespace(t *testing.T) {
+    for v, expect := range map[string]bool{"cliv2.0": true, "1.2-beta": true, "": false, ".": false, "..": false, "a/b": false, "..\\x": false, "c:": false, "temp": false, "quarantine": false} {
+        if namespace(v) != expect { t.Errorf("namespace %q != %v", v, expect) }
+    }
+}
+
+func TestPurge(t *testing.T) {
+    base := t.TempDir()
+    roots, err := parseRoots(path.Join(base, "root"))
+    if err != nil { t.Fatal(err) }
+    r := roots[0]
+    if err := r.open(); err != nil { t.Fatal(err) }
+    defer r.index.close()
+    uuid := strings.Repeat("ef", 32)
+    for _, v := range []string{"v1", "v2"} {
+        m := &Meta{Version: v, Uuid: uuid, Type: 1, Size: 4}
+        name := r.entry(m)
+        if err := os.MkdirAll(path.Dir(name), 0700); err != nil { t.Fatal(err) }
+        if err := ioutil.WriteFile(name, []byte("data"), 0600); err != nil { t.Fatal(err) }
+        r.index.put(m)
+    }
+    sibling := path.Join(base, "sibling")
+    if err := ioutil.WriteFile(sibling, nil, 0600); err != nil { t.Fatal(err) }
+
+    s := &CacheServer{roots: roots}
+    for _, v := range []string{"", ".", "..", "v1/" + uuid[:2], "temp"} {
+        s.purge(r, v, &CleanReport{})
+    }
+    for _, name := range []string{sibling, path.Join(r.path, "index.log"), r.entry(&Meta{Version: "v1", Uuid: uuid, Type: 1})} {
+        if _, err := os.Stat(name); err != nil { t.Fatalf("purge of invalid namespace removed %s", name) }
+    }
+    report := &CleanReport{}
+    s.purge(r, "v1", report)
+    if _, err := os.Stat(path.Join(r.path, "v1")); !os.IsNotExist(err) { t.Fatalf("namespace left: %v", err) }
+    if _, ok := r.index.get("v1", uuid, 1); ok || report.Files != 1 { t.Fatalf("namespace indexed after purge, report %+v", report) }
+    if _, ok := r.index.get("v2", uuid, 1); !ok { t.Fatalf("other namespace purged") }
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+    "bytes"
+    "compress/flate"
+    "encoding/binary"
+    "io"
+    "os"
+)
+
+// Feature bits negotiated per connection with command 'n'
+const (
+    FeatureGzip uint32 = 1 << iota
+    FeaturePutAck
+    FeatureJobs
+)
+
+const supported = FeatureGzip | FeaturePutAck | FeatureJobs
+
+// Encodings of entry bodies, sent after body size on connections that negotiated FeatureGzip
+const (
+    EncodingIdentity byte = iota
+    EncodingGzip
+)
+
+const gzipSuffix = ".gz"
+
+func encodingName(e byte) string {
+    if e == EncodingGzip {return "gzip"}
+    return ""
+}
+
+func encodingOf(m *Meta) byte {
+    if m.Encoding == "gzip" {return EncodingGzip}
+    return EncodingIdentity
+}
+
+var magics = [][]byte{
+    {0x1f, 0x8b},                         // gzip
+    {0x50, 0x4b, 0x03, 0x04},             // zip, jar, apk
+    {0x89, 0x50, 0x4e, 0x47},             // png
+    {0xff, 0xd8, 0xff},                   // jpeg
+    {0x28, 0xb5, 0x2f, 0xfd},             // zstd
+    {0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}, // xz
+    {0x42, 0x5a, 0x68},                   // bzip2
+    {0x37, 0x7a, 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+    {0x04, 0x22, 0x4d, 0x18},             // lz4
+    {0x55, 0x6e, 0x69, 0x74, 0x79, 0x46, 0x53}, // UnityFS asset bundle
+}
+
+// compressible sniffs head of content, skipping known compressed formats and content that deflates poorly
+func compressible(head []byte) bool {
+    if len(head) < 512 {return false}
+    for _, m := range magics {
+        if bytes.HasPrefix(head, m) {return false}
+    }
+    var b bytes.Buffer
+    w, _ := flate.NewWriter(&b, flate.BestSpeed)
+    w.Write(head)
+    w.Close()
+    return b.Len() < len(head) * 9 / 10
+}
+
+// gzipSize reads uncompressed size from gzip trailer, which is exact for content below 4GB
+func gzipSize(name string) int64 {
+    file, err := os.Open(name)
+    if err != nil {return 0}
+    defer file.Close()
+    b := make([]byte, 4)
+    if s, err := file.Stat(); err != nil || s.Size() < 4 {return 0} else {
+        if _, err := file.ReadAt(b, s.Size() - 4); err != nil {return 0}
+    }
+    return int64(binary.LittleEndian.Uint32(b))
+}
+
+// decoder adapts a decompressing reader to Stream, closing it closes the underlying file
+type decoder struct {
+    io.Reader
+    c io.Closer
+}
+
+func (d *decoder) Write(p []byte) (int, error) { return len(p), nil }
+func (d *decoder) Close() error { return d.c.Close() }
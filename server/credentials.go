@@ -0,0 +1,98 @@
+package server
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+)
+
+// Credential authenticates url fills of hosts matched by Match, formatted as [scheme://]host-pattern like FetchRule.
+// Secret values written as $NAME are read from environment so that the file itself may be shared.
+type Credential struct {
+    Match    string            `json:"match"`
+    Bearer   string            `json:"bearer,omitempty"`
+    User     string            `json:"user,omitempty"`
+    Password string            `json:"password,omitempty"`
+    Headers  map[string]string `json:"headers,omitempty"`
+    Cert     string            `json:"cert,omitempty"` // client certificate pem file
+    Key      string            `json:"key,omitempty"`  // private key pem file of Cert
+    CA       string            `json:"ca,omitempty"`   // pem file of extra roots trusted for matched hosts
+    rule     *FetchRule
+    tls      *tls.Config
+    client   *http.Client
+    once     sync.Once
+}
+
+// Credentials are tried in file order, the first match applies
+type Credentials []*Credential
+
+// LoadCredentials reads a json array of credentials from file name
+func LoadCredentials(name string) (Credentials, error) {
+    b, err := ioutil.ReadFile(name)
+    if err != nil {return nil, err}
+    var v Credentials
+    if err := json.Unmarshal(b, &v); err != nil {return nil, fmt.Errorf("credentials %s: %v", name, err)}
+    for _, c := range v {
+        if err := c.init(); err != nil {return nil, fmt.Errorf("credentials %s: %s: %v", name, c.Match, err)}
+    }
+    return v, nil
+}
+
+func secret(v string) string {
+    if strings.HasPrefix(v, "$") {return os.Getenv(v[1:])}
+    return v
+}
+
+func (c *Credential) init() error {
+    rule, err := ParseFetchRule(c.Match)
+    if err != nil {return err}
+    c.rule = rule
+    c.Bearer, c.User, c.Password = secret(c.Bearer), secret(c.User), secret(c.Password)
+    for k, v := range c.Headers { c.Headers[k] = secret(v) }
+    if c.Cert == "" && c.CA == "" {return nil}
+    c.tls = &tls.Config{}
+    if c.Cert != "" {
+        cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+        if err != nil {return err}
+        c.tls.Certificates = []tls.Certificate{cert}
+    }
+    if c.CA != "" {
+        b, err := ioutil.ReadFile(c.CA)
+        if err != nil {return err}
+        pool, err := x509.SystemCertPool()
+        if err != nil { pool = x509.NewCertPool() }
+        if !pool.AppendCertsFromPEM(b) {return fmt.Errorf("no certificate found in %s", c.CA)}
+        c.tls.RootCAs = pool
+    }
+    return nil
+}
+
+func (v Credentials) match(u *url.URL) *Credential {
+    for _, c := range v {
+        if (FetchRules{c.rule}).allow(u) {return c}
+    }
+    return nil
+}
+
+// apply authenticates request r, bearer token takes precedence over basic auth
+func (c *Credential) apply(r *http.Request) {
+    switch {
+    case c.Bearer != "": r.Header.Set("Authorization", "Bearer "+c.Bearer)
+    case c.User != "": r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.User+":"+c.Password)))
+    }
+    for k, v := range c.Headers { r.Header.Set(k, v) }
+}
+
+// strip removes what apply added, before a redirect leaves hosts of c
+func (c *Credential) strip(r *http.Request) {
+    if c.Bearer != "" || c.User != "" { r.Header.Del("Authorization") }
+    for k := range c.Headers { r.Header.Del(k) }
+}
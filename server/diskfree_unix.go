@@ -0,0 +1,23 @@
+// +build !windows
+
+package server
+
+import (
+    "errors"
+    "syscall"
+)
+
+func diskFree(dir string) (int64, int64, error) {
+    var st syscall.Statfs_t
+    if err := syscall.Statfs(dir, &st); err != nil {return 0, 0, err}
+    return int64(st.Bavail) * int64(st.Bsize), int64(st.Blocks) * int64(st.Bsize), nil
+}
+
+// syncDir makes renames into dir durable
+func syncDir(dir string) error {
+    return syncFile(dir)
+}
+
+func isFull(err error) bool {
+    return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+    "errors"
+    "syscall"
+    "unsafe"
+)
+
+/* same call as windows.GetDiskFreeSpaceEx of golang.org/x/sys, whose releases with it need a newer go than this module */
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func diskFree(dir string) (int64, int64, error) {
+    name, err := syscall.UTF16PtrFromString(dir)
+    if err != nil {return 0, 0, err}
+    var free, total, all uint64
+    if r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&all))); r == 0 {return 0, 0, err}
+    return int64(free), int64(total), nil
+}
+
+// syncDir is a no-op since directories can not be opened for sync on windows, where metadata of renames is journaled by NTFS
+func syncDir(dir string) error {
+    return nil
+}
+
+func isFull(err error) bool {
+    return errors.Is(err, syscall.Errno(112)) /* ERROR_DISK_FULL */
+}
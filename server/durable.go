@@ -0,0 +1,145 @@
+package server
+
+import (
+    "errors"
+    "go.uber.org/zap"
+    "os"
+    "path"
+    "time"
+)
+
+const (
+    DurabilityNone  = "none"  // rename without sync, fastest but entries may be truncated after power loss
+    DurabilityPut   = "put"   // sync every temp file before rename and its directory after
+    DurabilityBatch = "batch" // defer renames into group commits that share syncs
+)
+
+type pending struct {
+    root *root
+    temp string
+    name string
+    meta *Meta
+    done chan error
+}
+
+var errClosed = errors.New("server closed")
+
+// commit moves a finished temp file into place and records it into index, with regard to durability mode,
+// in batch mode it returns once the group commit including it is durable
+func (s *CacheServer) commit(r *root, temp string, name string, meta *Meta) error {
+    switch s.Durability {
+    case DurabilityBatch:
+        p := &pending{root: r, temp: temp, name: name, meta: meta, done: make(chan error, 1)}
+        s.committing.RLock()
+        if s.pending == nil {
+            s.committing.RUnlock()
+            os.Remove(temp)
+            return errClosed
+        }
+        s.pending <- p
+        s.committing.RUnlock()
+        return <-p.done
+    case DurabilityPut:
+        if err := syncFile(temp); err != nil {os.Remove(temp);return err}
+        if err := settle(temp, name); err != nil {return err}
+        if err := syncDir(path.Dir(name)); err != nil { logger.Warn("sync dir", zap.String("name", name), zap.Error(err)) }
+    default:
+        if err := settle(temp, name); err != nil {return err}
+    }
+    if meta != nil { s.replace(r, name, meta) }
+    return nil
+}
+
+// settle renames temp into name, its directory is created only now because janitor prunes empty ones while entries are still received
+func settle(temp string, name string) error {
+    if err := mkdir(path.Dir(name)); err != nil {return err}
+    return os.Rename(temp, name)
+}
+
+// replace records meta of a committed entry and removes the stale file stored with the other encoding
+func (s *CacheServer) replace(r *root, name string, meta *Meta) {
+    r.index.put(meta)
+    stale := r.filename(meta.Version, meta.Uuid, meta.Type)
+    if stale == name { stale += gzipSuffix }
+    os.Remove(stale)
+    for _, o := range s.roots {
+        if o == r {continue}
+        if m, ok := o.index.get(meta.Version, meta.Uuid, meta.Type); ok {
+            os.Remove(o.entry(&m))
+            o.index.remove(&m)
+        }
+    }
+}
+
+// group collects pending commits during GroupCommit window, then syncs files, renames them and syncs each directory once,
+// every commit is told its outcome after directories are synced, and remaining ones are committed once queue is closed
+func (s *CacheServer) group(queue chan *pending, grouped chan struct{}) {
+    defer close(grouped)
+    window := s.GroupCommit
+    if window <= 0 { window = 10 * time.Millisecond }
+    for p := range queue {
+        batch := []*pending{p}
+        timer := time.After(window)
+        for collect := true; collect; {
+            select {
+            case p, ok := <-queue:
+                if ok { batch = append(batch, p) } else { collect = false }
+            case <-timer: collect = false
+            }
+        }
+
+        ts := time.Now()
+        dirs := map[string]struct{}{}
+        var done []*pending
+        for _, p := range batch {
+            if err := syncFile(p.temp); err != nil {
+                logger.Error("group commit sync", zap.String("temp", p.temp), zap.Error(err))
+                os.Remove(p.temp)
+                p.done <- err
+                continue
+            }
+            if err := settle(p.temp, p.name); err != nil {
+                logger.Error("group commit rename", zap.String("name", p.name), zap.Error(err))
+                p.done <- err
+                continue
+            }
+            dirs[path.Dir(p.name)] = struct{}{}
+            if p.meta != nil { s.replace(p.root, p.name, p.meta) }
+            done = append(done, p)
+        }
+        for dir := range dirs {
+            if err := syncDir(dir); err != nil { logger.Warn("group commit sync dir", zap.String("dir", dir), zap.Error(err)) }
+        }
+        for _, p := range done { p.done <- nil }
+        logger.Debug("group commit", zap.Int("files", len(batch)), zap.Int("dirs", len(dirs)), zap.Duration("elapse", time.Since(ts)))
+    }
+}
+
+// drain stops accepting batch commits and waits until queued ones are committed
+func (s *CacheServer) drain() {
+    s.committing.Lock()
+    queue := s.pending
+    s.pending = nil
+    s.committing.Unlock()
+    if queue == nil {return}
+    close(queue)
+    <-s.grouped
+}
+
+func syncFile(name string) error {
+    file, err := os.Open(name)
+    if err != nil {return err}
+    defer file.Close()
+    return file.Sync()
+}
+
+// verify rejects an opened entry whose size disagrees with its recorded meta, which happens after torn writes,
+// an entry committed again since m was read is judged by its current meta and never removed
+func (s *CacheServer) verify(r *root, m *Meta, size int64) bool {
+    if m.Disk() == size {return true}
+    if current, ok := r.index.get(m.Version, m.Uuid, m.Type); !ok || current.Created != m.Created {return ok && current.Disk() == size}
+    name := r.entry(m)
+    logger.Error("entry size mismatch", zap.String("file", name), zap.Int64("size", size), zap.Int64("expect", m.Disk()))
+    if err := os.Remove(name); err == nil || os.IsNotExist(err) { r.index.remove(m) }
+    return false
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+    "io/ioutil"
+    "os"
+    "path"
+    "strings"
+    "testing"
+)
+
+func TestVerifyReplaced(t *testing.T) {
+    roots, err := parseRoots(t.TempDir())
+    if err != nil { t.Fatal(err) }
+    r := roots[0]
+    if err := r.open(); err != nil { t.Fatal(err) }
+    defer r.index.close()
+    s := &CacheServer{roots: roots}
+    stale := &Meta{Version: "v", Uuid: strings.Repeat("04", 32), Type: 1, Size: 4, Created: 1}
+    name := r.entry(stale)
+    if err := os.MkdirAll(path.Dir(name), 0700); err != nil { t.Fatal(err) }
+    if err := ioutil.WriteFile(name, []byte("newer"), 0600); err != nil { t.Fatal(err) }
+    r.index.put(&Meta{Version: "v", Uuid: stale.Uuid, Type: 1, Size: 5, Created: 2}) /* committed after stale was located */
+    if !s.verify(r, stale, 5) { t.Fatalf("newer entry rejected") }
+    if _, err := os.Stat(name); err != nil { t.Fatalf("newer entry removed: %v", err) }
+    if _, ok := r.index.get("v", stale.Uuid, 1); !ok { t.Fatalf("newer record removed") }
+
+    torn := &Meta{Version: "v", Uuid: stale.Uuid, Type: 1, Size: 5, Created: 2}
+    if s.verify(r, torn, 3) { t.Fatalf("torn entry accepted") }
+    if _, err := os.Stat(name); !os.IsNotExist(err) { t.Fatalf("torn entry kept: %v", err) }
+}
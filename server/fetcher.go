@@ -0,0 +1,179 @@
+package server
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "go.uber.org/zap"
+    "net"
+    "net/http"
+    "net/url"
+    "path"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// FetchRule allows urls of Scheme whose host matches Pattern, an empty Scheme allows both http and https.
+// Hosts of gocache urls are servers, those of s3 urls are buckets and file urls have none, which only * matches.
+type FetchRule struct {
+    Scheme  string
+    Pattern string
+}
+
+func (a *FetchRule) String() string {
+    if a.Scheme == "" {return a.Pattern}
+    return a.Scheme + "://" + a.Pattern
+}
+
+// ParseFetchRule parses rules formatted as [scheme://]host-pattern, e.g. https://*.example.com
+func ParseFetchRule(v string) (*FetchRule, error) {
+    a := &FetchRule{Pattern: v}
+    if i := strings.Index(v, "://"); i >= 0 { a.Scheme, a.Pattern = v[:i], v[i+3:] }
+    if a.Pattern == "" {return nil, fmt.Errorf("fetch rule without host: %s", v)}
+    if _, err := path.Match(a.Pattern, ""); err != nil {return nil, err}
+    return a, nil
+}
+
+// FetchRules implements flag.Value so that allowed hosts can be repeated on command line
+type FetchRules []*FetchRule
+
+func (c *FetchRules) String() string {
+    var v []string
+    for _, a := range *c { v = append(v, a.String()) }
+    return strings.Join(v, " ")
+}
+
+func (c *FetchRules) Set(v string) error {
+    a, err := ParseFetchRule(v)
+    if err != nil {return err}
+    *c = append(*c, a)
+    return nil
+}
+
+// allow reports whether u may be fetched, any url of a registered scheme is allowed when there are no rules
+// except gocache and s3 ones, which reach servers and buckets with secrets of this server and need a rule of their scheme
+func (c FetchRules) allow(u *url.URL) bool {
+    if len(c) == 0 {return u.Scheme != "gocache" && u.Scheme != "s3"}
+    host := strings.ToLower(u.Hostname())
+    for _, a := range c {
+        if a.Scheme == "" && u.Scheme != "http" && u.Scheme != "https" {continue}
+        if a.Scheme != "" && a.Scheme != u.Scheme {continue}
+        if ok, _ := path.Match(a.Pattern, host); ok {return true}
+    }
+    return false
+}
+
+// names reports whether a rule names host exactly rather than by a wildcard pattern
+func (c FetchRules) names(host string) bool {
+    host = strings.ToLower(host)
+    for _, a := range c {
+        if a.Pattern == host && !strings.ContainsAny(a.Pattern, "*?[\\") {return true}
+    }
+    return false
+}
+
+// internal reports whether ip is loopback, link-local, private or unspecified, which url fills must not reach unless a rule names their host
+func internal(ip net.IP) bool {
+    if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {return true}
+    if v4 := ip.To4(); v4 != nil {
+        return v4[0] == 0 || v4[0] == 10 || v4[0] == 172 && v4[1] & 0xf0 == 16 || v4[0] == 192 && v4[1] == 168 || v4[0] == 100 && v4[1] & 0xc0 == 64 /* carrier-grade NAT */
+    }
+    return len(ip) == net.IPv6len && ip[0] & 0xfe == 0xfc /* unique local */
+}
+
+// guard refuses connecting to internal addresses, it checks address being connected after resolution so that dns can't smuggle one in
+func guard(network, address string, _ syscall.RawConn) error {
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {return err}
+    if ip := net.ParseIP(host); ip != nil && internal(ip) {return fmt.Errorf("fetch address not allowed: %s", address)}
+    return nil
+}
+
+// idleConn fails reads that stall longer than idle
+type idleConn struct {
+    net.Conn
+    idle time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+    c.SetReadDeadline(time.Now().Add(c.idle))
+    return c.Conn.Read(p)
+}
+
+// httpError is a fetch failure worth retrying when temporary is set
+type httpError struct {
+    status    int
+    url       string
+    temporary bool
+}
+
+func (e *httpError) Error() string { return fmt.Sprintf("fetch %s status %d", e.url, e.status) }
+
+func (s *CacheServer) fetchTimeout() time.Duration {
+    if s.FetchTimeout > 0 {return s.FetchTimeout}
+    return 10 * time.Second
+}
+
+// fetcher returns http client of url fills with credential c, which has a client of its own when it presents a certificate
+func (s *CacheServer) fetcher(c *Credential) *http.Client {
+    if c != nil && c.tls != nil {
+        c.once.Do(func() { c.client = s.newFetcher(c.tls) })
+        return c.client
+    }
+    s.fetcherOnce.Do(func() { s.httpClient = s.newFetcher(nil) })
+    return s.httpClient
+}
+
+// newFetcher creates http client whose connections time out on connect, response header and stalled reads,
+// internal addresses are refused unless a rule names host being dialed, which is the proxy when there is one
+func (s *CacheServer) newFetcher(config *tls.Config) *http.Client {
+    timeout := s.fetchTimeout()
+    dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+    guarded := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second, Control: guard}
+    transport := &http.Transport{
+        Proxy: http.ProxyFromEnvironment,
+        DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+            d := guarded
+            if host, _, err := net.SplitHostPort(addr); err == nil && s.FetchAllow.names(host) { d = dialer }
+            c, err := d.DialContext(ctx, network, addr)
+            if err != nil {return nil, err}
+            return &idleConn{Conn: c, idle: timeout}, nil
+        },
+        TLSClientConfig:       config,
+        TLSHandshakeTimeout:   timeout,
+        ResponseHeaderTimeout: timeout,
+        IdleConnTimeout:       90 * time.Second,
+        MaxIdleConnsPerHost:   8,
+    }
+    return &http.Client{Transport: transport, CheckRedirect: func(r *http.Request, via []*http.Request) error {
+        if len(via) >= 5 {return fmt.Errorf("fetch %s: too many redirects", via[0].URL)}
+        if !s.FetchAllow.allow(r.URL) {return fmt.Errorf("fetch redirect not allowed: %s", r.URL)}
+        if c := s.credentials.match(via[len(via)-1].URL); c != nil { c.strip(r) } /* never leak secrets to another host */
+        if c := s.credentials.match(r.URL); c != nil { c.apply(r) }
+        return nil
+    }}
+}
+
+// download gets u with retries and backoff applying credential c, only a 2xx response is returned, or a 304 to a conditional request with header
+func (s *CacheServer) download(u string, header http.Header, c *Credential) (*http.Response, error) {
+    backoff := 200 * time.Millisecond
+    for i := 0; ; i++ {
+        req, err := http.NewRequest(http.MethodGet, u, nil)
+        if err != nil {return nil, err}
+        for k, v := range header { req.Header[k] = v }
+        if c != nil { c.apply(req) }
+        rsp, err := s.fetcher(c).Do(req)
+        if err == nil && header != nil && rsp.StatusCode == http.StatusNotModified {return rsp, nil}
+        if err == nil && (rsp.StatusCode < 200 || rsp.StatusCode >= 300) {
+            rsp.Body.Close()
+            err = &httpError{status: rsp.StatusCode, url: u, temporary: rsp.StatusCode >= 500 || rsp.StatusCode == http.StatusTooManyRequests}
+        }
+        if err == nil {return rsp, nil}
+        if e, ok := err.(*httpError); ok && !e.temporary {return nil, err}
+        if i >= s.FetchRetries {return nil, err}
+        logger.Warn("fetch retry", zap.String("url", u), zap.Int("attempt", i+1), zap.Duration("backoff", backoff), zap.Error(err))
+        time.Sleep(backoff)
+        backoff *= 2
+    }
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+    "bytes"
+    "fmt"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync/atomic"
+    "testing"
+)
+
+func TestFetchRules(t *testing.T) {
+    var rules FetchRules
+    for _, v := range []string{"https://*.example.com", "cdn.example.org", "s3://builds", "10.0.0.5"} {
+        if err := rules.Set(v); err != nil { t.Fatal(err) }
+    }
+    for u, expect := range map[string]bool{
+        "https://a.example.com/x": true,
+        "http://a.example.com/x": false,
+        "http://cdn.example.org/x": true,
+        "https://CDN.example.org/x": true,
+        "s3://builds/x": true,
+        "s3://cdn.example.org/x": false,
+        "gocache://cdn.example.org/v/u/1": false,
+    } {
+        target, _ := url.Parse(u)
+        if rules.allow(target) != expect { t.Errorf("allow %s != %v", u, expect) }
+    }
+    var none FetchRules
+    for u, expect := range map[string]bool{"https://a.example.com/x": true, "gocache://10.0.0.5/v/u/1": false, "s3://builds/x": false} {
+        target, _ := url.Parse(u)
+        if none.allow(target) != expect { t.Errorf("allow %s without rules != %v", u, expect) }
+    }
+    if !rules.names("10.0.0.5") || !rules.names("CDN.example.org") || rules.names("a.example.com") {
+        t.Errorf("names exact hosts only")
+    }
+}
+
+func TestInternal(t *testing.T) {
+    for ip, expect := range map[string]bool{
+        "127.0.0.1": true, "10.1.2.3": true, "172.16.0.1": true, "172.31.255.255": true, "192.168.1.1": true,
+        "169.254.169.254": true, "100.64.0.1": true, "0.0.0.0": true, "::1": true, "fe80::1": true, "fd00::1": true,
+        "::ffff:127.0.0.1": true, "172.32.0.1": false, "8.8.8.8": false, "100.128.0.1": false, "2001:4860::8888": false,
+    } {
+        if internal(net.ParseIP(ip)) != expect { t.Errorf("internal %s != %v", ip, expect) }
+    }
+}
+
+// fetching returns a server answering requests with handler and a CacheServer whose rules allow it
+func fetching(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *CacheServer) {
+    srv := httptest.NewServer(handler)
+    s := &CacheServer{}
+    s.registerFetchers()
+    if err := s.FetchAllow.Set("127.0.0.1"); err != nil { t.Fatal(err) }
+    return srv, s
+}
+
+func TestFetchLoopback(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("internal")) }))
+    defer srv.Close()
+    for _, rules := range [][]string{nil, {"*"}, {"127.0.0.*"}} {
+        s := &CacheServer{}
+        s.registerFetchers()
+        for _, v := range rules { s.FetchAllow.Set(v) }
+        if _, err := s.open(srv.URL, nil); err == nil || !strings.Contains(err.Error(), "address not allowed") {
+            t.Fatalf("loopback fetched with rules %v: %v", rules, err)
+        }
+    }
+}
+
+func TestFetchStatus(t *testing.T) {
+    requests := int32(0)
+    srv, s := fetching(t, func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&requests, 1)
+        http.NotFound(w, r)
+    })
+    defer srv.Close()
+    s.FetchRetries = 2
+    _, err := s.open(srv.URL + "/a.bin", nil)
+    if e, ok := err.(*httpError); !ok || e.status != http.StatusNotFound {
+        t.Fatalf("404 fetched: %v", err)
+    }
+    if n := atomic.LoadInt32(&requests); n != 1 { t.Fatalf("404 requested %d times", n) }
+}
+
+func TestFetchRetry(t *testing.T) {
+    requests := int32(0)
+    srv, s := fetching(t, func(w http.ResponseWriter, r *http.Request) {
+        if atomic.AddInt32(&requests, 1) <= 2 {
+            http.Error(w, "busy", http.StatusServiceUnavailable)
+            return
+        }
+        w.Write([]byte("content"))
+    })
+    defer srv.Close()
+    s.FetchRetries = 1
+    if _, err := s.open(srv.URL, nil); err == nil || !strings.Contains(err.Error(), "status 503") {
+        t.Fatalf("fetched before retries were exhausted: %v", err)
+    }
+    s.FetchRetries = 2
+    atomic.StoreInt32(&requests, 0)
+    b, _, err := read(t, s, srv.URL, nil)
+    if err != nil || string(b) != "content" { t.Fatalf("retry: %q %v", b, err) }
+    if n := atomic.LoadInt32(&requests); n != 3 { t.Fatalf("requested %d times", n) }
+}
+
+func TestFetchMax(t *testing.T) {
+    content := bytes.Repeat([]byte("x"), 64<<10)
+    srv, s := fetching(t, func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/chunked" {
+            for i := 0; i < len(content); i += 4 << 10 {
+                w.Write(content[i:i + 4<<10])
+                w.(http.Flusher).Flush()
+            }
+            return
+        }
+        w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+        w.Write(content)
+    })
+    defer srv.Close()
+    s.FetchMax = 16 << 10
+    if _, err := s.open(srv.URL, nil); err == nil || !strings.Contains(err.Error(), "exceeds") {
+        t.Fatalf("declared size beyond fetch max: %v", err)
+    }
+
+    roots, err := parseRoots(t.TempDir())
+    if err != nil { t.Fatal(err) }
+    r := roots[0]
+    if err := r.open(); err != nil { t.Fatal(err) }
+    defer r.index.close()
+    s.roots = roots
+    uuid := strings.Repeat("cd", 32)
+    for _, max := range []int64{16 << 10, 0} {
+        s.FetchMax = max
+        expect := max == 0
+        f, _ := s.fetches.join(metaKey("v", uuid, 1))
+        s.launch(f, srv.URL + "/chunked", r, &Meta{Version: "v", Uuid: uuid, Type: 1})
+        err := f.wait()
+        if (err == nil) != expect { t.Fatalf("chunked fetch with fetch max %d: %v", max, err) }
+        m, ok := r.index.get("v", uuid, 1)
+        if ok != expect || ok && m.Size != int64(len(content)) { t.Fatalf("chunked fetch with fetch max %d stored %v %d", max, ok, m.Size) }
+    }
+}
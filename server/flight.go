@@ -0,0 +1,294 @@
+package server
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "go.uber.org/zap"
+    "io"
+    "math/rand"
+    "os"
+    "path"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// flight is an in-progress upstream fetch, put or memory fill of one key, concurrent requests of the key join it instead of repeating it
+type flight struct {
+    key     string
+    size    int64
+    raw     int64
+    encoding byte
+    written int64
+    started bool
+    done    bool
+    err     error
+    file    *os.File /* fetched content, read by every joiner at its own offset while it is being written */
+    swap    sync.RWMutex /* held by joiners reading file, and by leader while file is reopened around commit */
+    refs    int32
+    cond    *sync.Cond
+    sync.Mutex
+}
+
+type flights struct {
+    m       map[string]*flight
+    leaders int64
+    joiners int64
+    sync.Mutex
+}
+
+// join returns the flight of key, leader is true when caller created it and must land it, otherwise caller must release it
+func (g *flights) join(key string) (*flight, bool) {
+    g.Lock()
+    defer g.Unlock()
+    if f, ok := g.m[key]; ok {
+        atomic.AddInt32(&f.refs, 1)
+        atomic.AddInt64(&g.joiners, 1)
+        return f, false
+    }
+    if g.m == nil { g.m = map[string]*flight{} }
+    f := &flight{key: key, refs: 1}
+    f.cond = sync.NewCond(&f.Mutex)
+    g.m[key] = f
+    atomic.AddInt64(&g.leaders, 1)
+    return f, true
+}
+
+// find returns a reader of the flight of key if there is one
+func (g *flights) find(key string) *flightReader {
+    g.Lock()
+    defer g.Unlock()
+    if f, ok := g.m[key]; ok {
+        atomic.AddInt64(&g.joiners, 1)
+        return f.reader()
+    }
+    return nil
+}
+
+// land finishes flight with err, later requests of key start over
+func (g *flights) land(f *flight, err error) {
+    g.Lock()
+    delete(g.m, f.key)
+    g.Unlock()
+    f.Lock()
+    f.done, f.err = true, err
+    f.cond.Broadcast()
+    f.Unlock()
+    f.release()
+}
+
+func (g *flights) stats() map[string]int64 {
+    return map[string]int64{"leaders": atomic.LoadInt64(&g.leaders), "joiners": atomic.LoadInt64(&g.joiners)}
+}
+
+// start publishes content file with its size and encoding, joiners block until then
+func (f *flight) start(file *os.File, size int64, encoding byte, raw int64) {
+    f.Lock()
+    f.file, f.size, f.encoding, f.raw, f.started = file, size, encoding, raw, true
+    f.cond.Broadcast()
+    f.Unlock()
+}
+
+// settle runs commit with content file closed, since Windows refuses to rename a file that is open, and reopens it at name once committed when joiners read it
+func (f *flight) settle(name string, commit func() error) error {
+    f.swap.Lock()
+    defer f.swap.Unlock()
+    if f.file == nil {return commit()}
+    f.file.Close()
+    f.file = nil /* stays so when commit fails, joiners fail along with flight */
+    err := commit()
+    if err != nil {return err}
+    if file, err := os.Open(name); err == nil { f.file = file } else { logger.Error("flight reopen", zap.String("name", name), zap.Error(err)) }
+    return nil
+}
+
+func (f *flight) progress(n int64) {
+    f.Lock()
+    f.written += n
+    f.cond.Broadcast()
+    f.Unlock()
+}
+
+// ready waits until content size is known, or returns why flight failed before that
+func (f *flight) ready() (int64, error) {
+    f.Lock()
+    defer f.Unlock()
+    for !f.started && !f.done { f.cond.Wait() }
+    if !f.started {return 0, f.err}
+    return f.size, nil
+}
+
+// await waits until cond holds or deadline passes, reporting whether cond holds
+func (f *flight) await(deadline time.Time, cond func() bool) bool {
+    t := time.AfterFunc(time.Until(deadline), func() {
+        f.Lock()
+        f.cond.Broadcast()
+        f.Unlock()
+    })
+    defer t.Stop()
+    f.Lock()
+    defer f.Unlock()
+    for !cond() && time.Now().Before(deadline) { f.cond.Wait() }
+    return cond()
+}
+
+func (f *flight) wait() error {
+    f.Lock()
+    defer f.Unlock()
+    for !f.done { f.cond.Wait() }
+    return f.err
+}
+
+// reader streams content from the beginning, waiting for bytes not fetched yet, caller must hold a reference of flight
+func (f *flight) reader() *flightReader {
+    atomic.AddInt32(&f.refs, 1)
+    return &flightReader{f: f}
+}
+
+func (f *flight) release() {
+    if atomic.AddInt32(&f.refs, -1) == 0 && f.file != nil { f.file.Close() }
+}
+
+type flightReader struct {
+    f   *flight
+    off int64
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+    f := r.f
+    f.Lock()
+    for r.off >= f.written && !f.done { f.cond.Wait() }
+    written, err := f.written, f.err
+    f.Unlock()
+    if r.off >= written {
+        if err != nil {return 0, err}
+        return 0, io.EOF
+    }
+    if int64(len(p)) > written - r.off { p = p[:written - r.off] }
+    f.swap.RLock()
+    n, err := f.file.ReadAt(p, r.off)
+    f.swap.RUnlock()
+    r.off += int64(n)
+    if err == io.EOF && n > 0 { err = nil }
+    return n, err
+}
+
+func (r *flightReader) Write(p []byte) (int, error) { return len(p), nil }
+
+func (r *flightReader) Close() error {
+    r.f.release()
+    return nil
+}
+
+// follow waits for an in-flight put as configured by PutWait and PutStream, returning r when its content can be streamed or nil to look key up again
+func (s *CacheServer) follow(r *flightReader) *flightReader {
+    f := r.f
+    if !f.await(time.Now().Add(s.PutWait), func() bool { return f.done || (s.PutStream && f.started) }) {
+        r.Close()
+        return nil
+    }
+    f.Lock()
+    ok := f.started && f.err == nil
+    f.Unlock()
+    if !ok {
+        r.Close()
+        return nil
+    }
+    return r
+}
+
+// launch requests url for a fetch flight led by caller, body is saved into a temp file of r by a background goroutine
+func (s *CacheServer) launch(f *flight, u string, r *root, meta *Meta) {
+    src, err := s.open(u, nil)
+    if err != nil {
+        logger.Error("fetch", zap.String("url", u), zap.Error(err))
+        s.fetches.land(f, err)
+        return
+    }
+    validators(meta, u, src)
+    s.spool(f, u, src.Body, src.Size, r, meta)
+}
+
+// spool starts fetch flight f with body of size bytes, which is saved into a temp file of r by a background goroutine.
+// Joiners of a body of unknown size, which is negative, wait until it is saved completely.
+func (s *CacheServer) spool(f *flight, u string, body io.ReadCloser, size int64, r *root, meta *Meta) {
+    if err := r.mktemp(); err != nil {
+        body.Close()
+        s.fetches.land(f, err)
+        return
+    }
+    name := make([]byte, 32)
+    rand.Read(name)
+    temp := path.Join(r.temp, hex.EncodeToString(name))
+    w, err := os.OpenFile(temp, os.O_CREATE | os.O_WRONLY, 0700)
+    if err != nil {
+        body.Close()
+        s.fetches.land(f, err)
+        return
+    }
+    in, err := os.Open(temp)
+    if err != nil {
+        body.Close()
+        w.Close()
+        os.Remove(temp)
+        s.fetches.land(f, err)
+        return
+    }
+    if size >= 0 { f.start(in, size, EncodingIdentity, size) } else {
+        f.Lock()
+        f.file, f.size = in, -1
+        f.Unlock()
+    }
+    logger.Debug("fetch", zap.Int64("size", size), zap.String("url", u))
+    go s.fetch(f, u, body, w, r, meta)
+}
+
+// fetch copies body into temp file w while joiners stream it, then commits it as entry of meta
+func (s *CacheServer) fetch(f *flight, u string, body io.ReadCloser, w *os.File, r *root, meta *Meta) {
+    defer body.Close()
+    temp := w.Name()
+    h := sha256.New()
+    buf := getBuffer(64<<10)
+    defer putBuffer(buf)
+    received := int64(0)
+    size := f.size
+    var failure error
+    for failure == nil {
+        n, err := body.Read(buf)
+        if s.FetchMax > 0 && received + int64(n) > s.FetchMax {
+            failure = fmt.Errorf("fetch size exceeds %d", s.FetchMax)
+            break
+        }
+        if n > 0 {
+            if _, err := w.Write(buf[:n]); err != nil {
+                failure = err
+                r.fail(err)
+                break
+            }
+            h.Write(buf[:n])
+            received += int64(n)
+            f.progress(int64(n))
+        }
+        if err == io.EOF {break}
+        failure = err
+    }
+    w.Close()
+    if failure == nil && size >= 0 && received != size { failure = io.ErrUnexpectedEOF }
+    if failure == nil {
+        filename := r.filename(meta.Version, meta.Uuid, meta.Type)
+        meta.Size = received
+        meta.Created = time.Now().UnixNano()
+        meta.Accessed = meta.Created
+        meta.Digest = hex.EncodeToString(h.Sum(nil))
+        if failure = f.settle(filename, func() error { return s.commit(r, temp, filename, meta) }); failure == nil { mcache.core.drop(meta.Key()) } /* forget replaced content */
+    }
+    if failure != nil {
+        os.Remove(temp)
+        logger.Error("fetch failure", zap.Int64("received", received), zap.Int64("expect", size), zap.String("url", u), zap.Error(failure))
+    } else {
+        if size < 0 { f.start(f.file, received, EncodingIdentity, received) }
+        logger.Debug("fetch success", zap.Int64("size", received), zap.String("url", u))
+    }
+    s.fetches.land(f, failure)
+}
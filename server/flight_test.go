@@ -0,0 +1,29 @@
+package server
+
+import (
+    "io/ioutil"
+    "os"
+    "path"
+    "testing"
+)
+
+func TestFlightSettle(t *testing.T) {
+    dir := t.TempDir()
+    temp, name := path.Join(dir, "temp"), path.Join(dir, "entry")
+    if err := ioutil.WriteFile(temp, []byte("content"), 0600); err != nil { t.Fatal(err) }
+    g := &flights{}
+    f, _ := g.join("k")
+    in, err := os.Open(temp)
+    if err != nil { t.Fatal(err) }
+    f.start(in, 7, EncodingIdentity, 7)
+    f.progress(7)
+    r := f.reader()
+    defer r.Close()
+    if err := f.settle(name, func() error {
+        if f.file != nil { t.Fatal("temp held open across commit") }
+        return os.Rename(temp, name)
+    }); err != nil { t.Fatal(err) }
+    if f.file == nil || f.file.Name() != name { t.Fatalf("flight not reading committed file") }
+    g.land(f, nil)
+    if b, err := ioutil.ReadAll(r); err != nil || string(b) != "content" { t.Fatalf("read %q %v", b, err) }
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "go.uber.org/zap"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Meta is what the server knows about a stored entry, independent of file system timestamps
+type Meta struct {
+    Version  string `json:"v"`
+    Uuid     string `json:"u"`
+    Type     int    `json:"t"`
+    Size     int64  `json:"s"`
+    Created  int64  `json:"c"`
+    Accessed int64  `json:"a"`
+    Hits     int64  `json:"h"`
+    Digest   string `json:"d,omitempty"`
+    Encoding string `json:"e,omitempty"`
+    Stored   int64  `json:"z,omitempty"`
+    Url      string `json:"url,omitempty"`
+    ETag     string `json:"etag,omitempty"`
+    Modified string `json:"lm,omitempty"`
+    Validated int64 `json:"val,omitempty"`
+    Checked  int64  `json:"chk,omitempty"` /* last revalidation attempt, which failed when later than Validated */
+}
+
+func (m *Meta) Key() string { return metaKey(m.Version, m.Uuid, m.Type) }
+
+// Disk returns size of stored file, which differs from Size for encoded entries
+func (m *Meta) Disk() int64 {
+    if m.Encoding != "" {return m.Stored}
+    return m.Size
+}
+
+func metaKey(version string, uuid string, t int) string {
+    return version + "/" + uuid + "/" + strconv.Itoa(t)
+}
+
+type record struct {
+    Op string `json:"op"`
+    Meta
+}
+
+// index keeps metas in memory and persists every change into an append-only log,
+// which is compacted once it grows far beyond the number of live entries
+type index struct {
+    name    string
+    entries map[string]*Meta
+    touched map[string]bool /* keys accessed since last flush, recorded once per flush instead of once per get */
+    file    *os.File
+    w       *bufio.Writer
+    records int
+    closed  bool
+    sync.Mutex
+}
+
+func openIndex(name string, root string, skips ...string) (*index, error) {
+    x := &index{name: name, entries: map[string]*Meta{}, touched: map[string]bool{}}
+    if _, err := os.Stat(name); err == nil {
+        if err := x.load(); err != nil {return nil, err}
+    } else if os.IsNotExist(err) {
+        x.scan(root, skips)
+    } else {return nil, err}
+    if err := x.compact(); err != nil {return nil, err}
+    go x.flush()
+    return x, nil
+}
+
+// load replays records of index log, a record that can't be decoded is skipped rather than failing startup
+func (x *index) load() error {
+    file, err := os.Open(x.name)
+    if err != nil {return err}
+    defer file.Close()
+    reader := bufio.NewReaderSize(file, 64<<10)
+    for {
+        line, err := reader.ReadBytes('\n') /* unlike bufio.Scanner, lines of any length */
+        if len(bytes.TrimSpace(line)) > 0 {
+            r := &record{}
+            if e := json.Unmarshal(line, r); e != nil {
+                logger.Warn("index skip record", zap.String("name", x.name), zap.Int("size", len(line)), zap.Error(e))
+            } else {
+                m := r.Meta
+                switch r.Op {
+                case "d": delete(x.entries, m.Key())
+                default: x.entries[m.Key()] = &m
+                }
+            }
+        }
+        if err == io.EOF {break}
+        if err != nil {return err}
+    }
+    logger.Info("index loaded", zap.String("name", x.name), zap.Int("entries", len(x.entries)))
+    return nil
+}
+
+// scan adds metas of files missing from index by storage layout root/version/uuid[:2]/uuid/type, it returns number of added entries
+func (x *index) scan(root string, skips []string) int {
+    ts := time.Now()
+    added := 0
+    filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+        if err != nil {return nil}
+        if info.IsDir() {
+            for _, dir := range skips { if name == dir {return filepath.SkipDir} }
+            return nil
+        }
+        rel, err := filepath.Rel(root, name)
+        if err != nil {return nil}
+        parts := strings.Split(filepath.ToSlash(rel), "/")
+        if len(parts) != 4 {return nil}
+        t, err := strconv.Atoi(strings.TrimSuffix(parts[3], gzipSuffix))
+        if err != nil {return nil}
+        x.Lock()
+        _, ok := x.entries[metaKey(parts[0], parts[2], t)]
+        x.Unlock()
+        if ok {return nil}
+        m := &Meta{Version: parts[0], Uuid: parts[2], Type: t, Size: info.Size(), Created: info.ModTime().UnixNano()}
+        if strings.HasSuffix(parts[3], gzipSuffix) {
+            m.Encoding = encodingName(EncodingGzip)
+            m.Stored = info.Size()
+            m.Size = gzipSize(name)
+        }
+        m.Accessed = m.Created
+        x.put(m)
+        added++
+        return nil
+    })
+    logger.Info("index scan", zap.String("root", root), zap.Int("added", added), zap.Int("entries", len(x.entries)), zap.Duration("elapse", time.Since(ts)))
+    return added
+}
+
+func (x *index) append(op string, m *Meta) {
+    if x.w == nil {return}
+    b, err := json.Marshal(&record{Op: op, Meta: *m})
+    if err != nil {return}
+    x.w.Write(b)
+    x.w.WriteByte('\n')
+    x.records++
+}
+
+// compact rewrites index log as a snapshot of entries, the current log keeps being appended when it fails so that it can be retried
+func (x *index) compact() error {
+    x.Lock()
+    defer x.Unlock()
+    if x.closed {return nil}
+
+    temp := x.name + ".tmp"
+    file, err := os.OpenFile(temp, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0700)
+    if err != nil {return err}
+    w := bufio.NewWriter(file)
+    for _, m := range x.entries {
+        b, err := json.Marshal(&record{Op: "p", Meta: *m})
+        if err != nil {continue}
+        w.Write(b)
+        w.WriteByte('\n')
+    }
+    if err = w.Flush(); err == nil { err = file.Sync() }
+    file.Close()
+    if err != nil {
+        os.Remove(temp)
+        return err
+    }
+
+    if x.w != nil { x.w.Flush() }
+    if x.file != nil { x.file.Close() } /* windows can't replace an open file */
+    x.file, x.w = nil, nil
+    err = os.Rename(temp, x.name)
+    if err != nil { os.Remove(temp) }
+    file, e := os.OpenFile(x.name, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0700) /* the snapshot, or previous log when rename failed */
+    if e != nil {return e}
+    x.file, x.w = file, bufio.NewWriter(file)
+    if err != nil {return err}
+    x.records = len(x.entries)
+    x.touched = map[string]bool{} /* accesses are in snapshot */
+    return nil
+}
+
+func (x *index) flush() {
+    for range time.Tick(time.Second) {
+        x.Lock()
+        if x.closed {
+            x.Unlock()
+            return
+        }
+        x.record()
+        if x.w != nil { x.w.Flush() }
+        garbage := x.w == nil || x.records > 2 * len(x.entries) + 4096 /* a log that failed to reopen is rewritten until it succeeds */
+        x.Unlock()
+        if garbage {
+            if err := x.compact(); err != nil { logger.Error("index compact", zap.String("name", x.name), zap.Error(err)) }
+        }
+    }
+}
+
+// record appends entries touched since last flush
+func (x *index) record() {
+    for key := range x.touched {
+        if m, ok := x.entries[key]; ok { x.append("p", m) }
+    }
+    x.touched = map[string]bool{}
+}
+
+func (x *index) put(m *Meta) {
+    x.Lock()
+    defer x.Unlock()
+    x.entries[m.Key()] = m
+    delete(x.touched, m.Key())
+    x.append("p", m)
+}
+
+// touch marks an access of entry, which is created on the fly when files predate the index, it is persisted by next flush
+func (x *index) touch(version string, uuid string, t int, size int64) Meta {
+    x.Lock()
+    defer x.Unlock()
+    ts := time.Now().UnixNano()
+    key := metaKey(version, uuid, t)
+    m, ok := x.entries[key]
+    if !ok {
+        m = &Meta{Version: version, Uuid: uuid, Type: t, Size: size, Created: ts}
+        x.entries[key] = m
+    }
+    m.Accessed = ts
+    m.Hits++
+    x.touched[key] = true
+    return *m
+}
+
+// update applies fn to entry under lock and records it, reporting whether entry exists
+func (x *index) update(version string, uuid string, t int, fn func(m *Meta)) bool {
+    x.Lock()
+    defer x.Unlock()
+    m, ok := x.entries[metaKey(version, uuid, t)]
+    if !ok {return false}
+    fn(m)
+    delete(x.touched, m.Key())
+    x.append("p", m)
+    return true
+}
+
+func (x *index) get(version string, uuid string, t int) (Meta, bool) {
+    x.Lock()
+    defer x.Unlock()
+    if m, ok := x.entries[metaKey(version, uuid, t)]; ok {return *m, true}
+    return Meta{}, false
+}
+
+func (x *index) remove(m *Meta) {
+    x.Lock()
+    defer x.Unlock()
+    delete(x.entries, m.Key())
+    delete(x.touched, m.Key())
+    x.append("d", m)
+}
+
+// list returns snapshots of entries in namespace, or all entries when version is empty
+func (x *index) list(version string) []Meta {
+    x.Lock()
+    defer x.Unlock()
+    var v []Meta
+    for _, m := range x.entries {
+        if version == "" || m.Version == version { v = append(v, *m) }
+    }
+    return v
+}
+
+// Namespace aggregates metas of one version
+type Namespace struct {
+    Version  string
+    Entries  int
+    Size     int64
+    Hits     int64
+    Created  int64
+    Accessed int64
+}
+
+func (x *index) namespaces() map[string]*Namespace {
+    x.Lock()
+    defer x.Unlock()
+    v := map[string]*Namespace{}
+    for _, m := range x.entries {
+        n, ok := v[m.Version]
+        if !ok {
+            n = &Namespace{Version: m.Version}
+            v[m.Version] = n
+        }
+        n.Entries++
+        n.Size += m.Disk()
+        n.Hits += m.Hits
+        if m.Accessed > n.Accessed { n.Accessed = m.Accessed }
+        if n.Created == 0 || m.Created < n.Created { n.Created = m.Created }
+    }
+    return v
+}
+
+func (x *index) close() error {
+    x.Lock()
+    defer x.Unlock()
+    x.record()
+    x.closed = true
+    if x.w != nil { x.w.Flush() }
+    x.w = nil /* later changes are not recorded */
+    if x.file != nil { return x.file.Close() }
+    return nil
+}
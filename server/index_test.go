@@ -0,0 +1,42 @@
+package server
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path"
+    "strings"
+    "testing"
+)
+
+func TestIndexLoadLongRecord(t *testing.T) {
+    dir := t.TempDir()
+    name := path.Join(dir, "index.log")
+    long := &Meta{Version: "v", Uuid: strings.Repeat("01", 32), Type: 1, Url: "https://example.com/" + strings.Repeat("x", 65<<10)}
+    b, err := json.Marshal(&record{Op: "p", Meta: *long})
+    if err != nil { t.Fatal(err) }
+    log := string(b) + "\n{broken\n" + `{"op":"p","v":"v","u":"` + strings.Repeat("02", 32) + `","t":1,"s":4}` + "\n"
+    if err := ioutil.WriteFile(name, []byte(log), 0600); err != nil { t.Fatal(err) }
+    x, err := openIndex(name, dir)
+    if err != nil { t.Fatal(err) }
+    defer x.close()
+    if m, ok := x.get("v", long.Uuid, 1); !ok || m.Url != long.Url { t.Fatalf("long record not loaded") }
+    if _, ok := x.get("v", strings.Repeat("02", 32), 1); !ok { t.Fatalf("record after broken one not loaded") }
+}
+
+func TestIndexCompactFailure(t *testing.T) {
+    dir := t.TempDir()
+    name := path.Join(dir, "index.log")
+    x, err := openIndex(name, dir)
+    if err != nil { t.Fatal(err) }
+    if err := os.Mkdir(name + ".tmp", 0700); err != nil { t.Fatal(err) } /* snapshot can't be created */
+    if err := x.compact(); err == nil { t.Fatalf("compact succeeded") }
+    uuid := strings.Repeat("03", 32)
+    x.put(&Meta{Version: "v", Uuid: uuid, Type: 1, Size: 4})
+    x.close()
+    os.Remove(name + ".tmp")
+    y, err := openIndex(name, dir)
+    if err != nil { t.Fatal(err) }
+    defer y.close()
+    if _, ok := y.get("v", uuid, 1); !ok { t.Fatalf("record after failed compaction lost") }
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+    "go.uber.org/zap"
+    "io/ioutil"
+    "os"
+    "path"
+    "sync/atomic"
+    "time"
+)
+
+// JanitorReport summarizes what a janitor pass reclaimed
+type JanitorReport struct {
+    Files   int
+    Size    int64
+    Dirs    int
+    Entries int
+    Adopted int
+}
+
+type janitorStats struct {
+    passes int64
+    files  int64
+    size   int64
+    dirs   int64
+}
+
+// recover runs before serving, so every temp file is an orphan of a previous process
+func (s *CacheServer) recover(r *root) *JanitorReport {
+    ts := time.Now()
+    report := &JanitorReport{}
+    s.sweep(r, 0, report)
+    for _, m := range r.index.list("") {
+        if _, err := os.Stat(r.entry(&m)); err != nil && os.IsNotExist(err) {
+            r.index.remove(&m)
+            report.Entries++
+        }
+    }
+    s.prune(r, r.path, 0, 0, report)
+    report.Adopted = r.adopt()
+    s.account(report)
+    logger.Info("recover", zap.String("root", r.path), zap.Int("adopted", report.Adopted), zap.Int("files", report.Files), zap.Int64("size", report.Size), zap.Int("dirs", report.Dirs), zap.Int("entries", report.Entries), zap.Duration("elapse", time.Since(ts)))
+    return report
+}
+
+func (s *CacheServer) janitor() {
+    if s.JanitorInterval <= 0 {return}
+    s.every(s.JanitorInterval, func() {
+        for _, r := range s.roots {
+            report := &JanitorReport{}
+            s.sweep(r, s.TempTTL, report)
+            s.prune(r, r.path, 0, s.TempTTL, report)
+            s.account(report)
+            if report.Files > 0 || report.Dirs > 0 {
+                logger.Info("janitor", zap.String("root", r.path), zap.Int("files", report.Files), zap.Int64("size", report.Size), zap.Int("dirs", report.Dirs))
+            }
+        }
+        s.forget()
+    })
+}
+
+func (s *CacheServer) account(report *JanitorReport) {
+    atomic.AddInt64(&s.janitorStats.passes, 1)
+    atomic.AddInt64(&s.janitorStats.files, int64(report.Files))
+    atomic.AddInt64(&s.janitorStats.size, report.Size)
+    atomic.AddInt64(&s.janitorStats.dirs, int64(report.Dirs))
+}
+
+// sweep removes temp files not modified within ttl
+func (s *CacheServer) sweep(r *root, ttl time.Duration, report *JanitorReport) {
+    list, err := ioutil.ReadDir(r.temp)
+    if err != nil {return}
+    ts := time.Now()
+    for _, info := range list {
+        if info.IsDir() || ts.Sub(info.ModTime()) < ttl {continue}
+        name := path.Join(r.temp, info.Name())
+        if err := os.Remove(name); err != nil {
+            logger.Error("janitor temp", zap.String("name", name), zap.Error(err))
+            continue
+        }
+        report.Files++
+        report.Size += info.Size()
+        logger.Debug("janitor temp", zap.String("name", name), zap.Int64("size", info.Size()), zap.Duration("age", ts.Sub(info.ModTime())))
+    }
+}
+
+// prune removes empty directories of layout version/uuid[:2]/uuid not modified within ttl, it reports whether dir is empty afterwards
+func (s *CacheServer) prune(r *root, dir string, depth int, ttl time.Duration, report *JanitorReport) bool {
+    if r.reserved(dir) {return false}
+    list, err := ioutil.ReadDir(dir)
+    if err != nil {return false}
+    empty := true
+    for _, info := range list {
+        if !info.IsDir() || depth >= 3 || time.Since(info.ModTime()) < ttl || !s.prune(r, path.Join(dir, info.Name()), depth+1, ttl, report) { empty = false }
+    }
+    if empty && depth > 0 {
+        if err := os.Remove(dir); err == nil {
+            report.Dirs++
+            return true
+        }
+    }
+    return false
+}
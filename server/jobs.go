@@ -0,0 +1,157 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "go.uber.org/zap"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// States of url put jobs reported by command 'j'
+const (
+    JobUnknown     byte = '?'
+    JobQueued      byte = 'q'
+    JobDownloading byte = 'd'
+    JobDone        byte = '+'
+    JobFailed      byte = '-'
+)
+
+// JobStatus reports a url put job, Size is -1 until upstream size is known
+type JobStatus struct {
+    Id       uint64
+    State    byte
+    Size     int64
+    Received int64
+    Reason   string
+}
+
+func (j *JobStatus) Finished() bool { return j.State == JobDone || j.State == JobFailed || j.State == JobUnknown }
+
+var errQueueFull = errors.New("job queue full")
+
+// job downloads url into entry of version, uuid and t by a worker of pool
+type job struct {
+    id       uint64
+    url      string
+    version  string
+    uuid     string
+    t        int
+    state    byte
+    err      error
+    flight   *flight
+    finished time.Time
+    sync.Mutex
+}
+
+type jobs struct {
+    m      map[uint64]*job
+    next   uint64
+    queue  chan *job
+    queued int64
+    failed int64
+    done   int64
+    sync.Mutex
+}
+
+// jobRetention is how long finished jobs stay queryable
+const jobRetention = 10 * time.Minute
+
+// submit creates a job of url and queues it, a job is failed at once when queue is full
+func (s *CacheServer) submit(u string, version string, uuid string, t int) *job {
+    j := &job{url: u, version: version, uuid: uuid, t: t, state: JobQueued}
+    s.jobs.Lock()
+    if s.jobs.m == nil { s.jobs.m = map[uint64]*job{} }
+    s.jobs.next++
+    j.id = s.jobs.next
+    s.jobs.m[j.id] = j
+    s.jobs.Unlock()
+    select {
+    case s.jobs.queue <- j: atomic.AddInt64(&s.jobs.queued, 1)
+    default:
+        logger.Warn("uput rejected", zap.String("url", u), zap.Error(errQueueFull))
+        s.finish(j, errQueueFull)
+    }
+    return j
+}
+
+// forget drops jobs finished longer than jobRetention ago, it runs with janitor passes so that submits never walk all jobs
+func (s *CacheServer) forget() {
+    s.jobs.Lock()
+    defer s.jobs.Unlock()
+    for k, o := range s.jobs.m {
+        o.Lock()
+        expired := !o.finished.IsZero() && time.Since(o.finished) > jobRetention
+        o.Unlock()
+        if expired { delete(s.jobs.m, k) }
+    }
+}
+
+func (s *CacheServer) finish(j *job, err error) {
+    j.Lock()
+    j.state, j.err, j.finished = JobDone, err, time.Now()
+    if err != nil { j.state = JobFailed }
+    j.Unlock()
+    if err != nil { atomic.AddInt64(&s.jobs.failed, 1) } else { atomic.AddInt64(&s.jobs.done, 1) }
+}
+
+// worker runs queued jobs one at a time
+func (s *CacheServer) worker() {
+    for j := range s.jobs.queue {
+        atomic.AddInt64(&s.jobs.queued, -1)
+        j.Lock()
+        j.state = JobDownloading
+        j.Unlock()
+        s.finish(j, s.work(j))
+    }
+}
+
+func (s *CacheServer) work(j *job) error {
+    lr, m, exists := s.locate(j.version, j.uuid, j.t)
+    if exists && !s.expired(&m) {
+        if s.stale(&m) { go s.revalidate(lr, m) }
+        return nil
+    }
+    r := s.place(j.uuid)
+    if r == nil {return fmt.Errorf("no writable root")}
+    f, leader := s.fetches.join(metaKey(j.version, j.uuid, j.t))
+    j.Lock()
+    j.flight = f
+    j.Unlock()
+    if leader { s.launch(f, j.url, r, &Meta{Version: j.version, Uuid: j.uuid, Type: j.t}) } else { defer f.release() }
+    err := f.wait()
+    if err != nil { logger.Warn("uput failed", zap.String("url", j.url), zap.Error(err)) }
+    return err
+}
+
+// status reports job of id, finished jobs are forgotten by the first janitor pass after jobRetention
+func (s *CacheServer) status(id uint64) *JobStatus {
+    s.jobs.Lock()
+    j, ok := s.jobs.m[id]
+    s.jobs.Unlock()
+    if !ok {return &JobStatus{Id: id, State: JobUnknown, Size: -1}}
+    j.Lock()
+    defer j.Unlock()
+    v := &JobStatus{Id: id, State: j.state, Size: -1}
+    if j.err != nil { v.Reason = j.err.Error() }
+    if f := j.flight; f != nil {
+        f.Lock()
+        v.Received = f.written
+        if f.started { v.Size = f.size }
+        f.Unlock()
+    }
+    return v
+}
+
+func (s *CacheServer) jobStats() map[string]int64 {
+    s.jobs.Lock()
+    tracked := int64(len(s.jobs.m))
+    s.jobs.Unlock()
+    return map[string]int64{
+        "tracked": tracked,
+        "queued": atomic.LoadInt64(&s.jobs.queued),
+        "done": atomic.LoadInt64(&s.jobs.done),
+        "failed": atomic.LoadInt64(&s.jobs.failed),
+    }
+}
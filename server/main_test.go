@@ -0,0 +1,17 @@
+package server
+
+import (
+    "go.uber.org/zap"
+    "os"
+    "testing"
+)
+
+func TestMain(m *testing.M) {
+    logger = zap.NewNop()
+    code := m.Run()
+    if upstream.s != nil {
+        upstream.s.Close()
+        os.RemoveAll(upstream.s.Path)
+    }
+    os.Exit(code)
+}
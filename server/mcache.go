@@ -2,12 +2,16 @@ package server
 
 import (
     "bytes"
+    "container/list"
     "errors"
     "fmt"
+    "hash/fnv"
     "go.uber.org/zap"
     "io"
     "os"
+    "sort"
     "sync"
+    "sync/atomic"
     "time"
     "unsafe"
 )
@@ -21,10 +25,13 @@ type File struct {
     w    io.Writer
     r    io.Reader
     c    bool
+    n    int64
 }
 
 func (f *File) Read(p []byte) (int, error) {
-    if f.r == nil { if f.f != nil {f.r = f.f} else {f.r = f.m} }
+    if f.r == nil {
+        if f.f == nil {f.r = f.m} else if f.m != nil {f.r = io.TeeReader(f.f, f.m)} else {f.r = f.f}
+    }
     return f.r.Read(p)
 }
 
@@ -35,7 +42,9 @@ func (f *File) Write(p []byte) (int, error) {
         if f.f != nil { w = append(w, f.f) }
         f.w = io.MultiWriter(w...)
     }
-    return f.w.Write(p)
+    n, err := f.w.Write(p)
+    f.n += int64(n)
+    return n, err
 }
 
 func (f *File) Close() error {
@@ -43,6 +52,7 @@ func (f *File) Close() error {
         if err := f.tryCache(); err == mcache.errors.cacherr {
             f.m.Reset()
             logger.Debug("pool", zap.Uintptr("put", uintptr(unsafe.Pointer(f.m))))
+            putBuffer(f.m.Bytes())
             f.m = nil
         }
     }()
@@ -63,89 +73,214 @@ func (f *File) tryCache() error {
 
 func (f *File) Name() string { return f.name }
 
+// load reads whole file into memory and caches it at once, afterwards file is served from memory as a cached one
+func (f *File) load() error {
+    if f.m == nil || f.f == nil {return nil}
+    if _, err := io.CopyN(f.m, f.f, f.size); err != nil {return err}
+    f.f.Close()
+    mcache.core.put(f.uuid, f.m)
+    f.m = bytes.NewBuffer(f.m.Bytes())
+    f.f, f.c = nil, true
+    return nil
+}
+
 type memEntity struct {
     data *bytes.Buffer
     uuid string
     size int64
     ts   int64
     hit  int
+    e    *list.Element
 }
 
-type memCache struct {
-    capacity int
+const memShards = 32
+
+// memShard is one lock stripe of memory cache, keeping its most recently used entries within capacity bytes
+type memShard struct {
+    capacity int64
     lookups  map[string]*memEntity
-    library  []*memEntity
+    lru      *list.List
     size     int64
-    g        int
-    p        int
-    n        int
-    sync.RWMutex
-}
-
-func (m *memCache) remove(uuid string) {
-    if entity, ok := m.lookups[uuid]; ok {
-        delete(m.lookups, entity.uuid)
-        m.size -= int64(entity.data.Cap())
-        for i := 0; i < len(m.library); i++ {
-            e := m.library[i]
-            if e.uuid == uuid {
-                m.library = append(m.library[:i], m.library[i+1:]...)
-                break
-            }
-        }
+    sync.Mutex
+}
+
+// memCache stripes entries over shards by uuid hash so that concurrent gets seldom contend, counters are updated atomically
+type memCache struct {
+    capacity  int64
+    g         int64
+    p         int64
+    n         int64
+    evictions int64
+    evicted   int64
+    declined  int64
+    shards    [memShards]memShard
+}
+
+func (m *memCache) init() {
+    for i := range m.shards {
+        m.shards[i].lookups = make(map[string]*memEntity)
+        m.shards[i].lru = list.New()
+    }
+}
+
+// resize splits capacity bytes evenly among shards, shrinking evicts immediately
+func (m *memCache) resize(capacity int64) {
+    atomic.StoreInt64(&m.capacity, capacity)
+    for i := range m.shards {
+        sh := &m.shards[i]
+        sh.Lock()
+        sh.capacity = capacity / memShards
+        m.shrink(sh)
+        sh.Unlock()
+    }
+}
+
+func (m *memCache) enabled() bool { return atomic.LoadInt64(&m.capacity) > 0 }
+
+// fits reports whether a buffer of size is within share of a shard, larger ones are declined by put
+func (m *memCache) fits(size int64) bool {
+    return int64(classOf(int(size))) <= atomic.LoadInt64(&m.capacity) / memShards
+}
+
+func (m *memCache) shard(uuid string) *memShard {
+    h := fnv.New32a()
+    h.Write([]byte(uuid))
+    return &m.shards[h.Sum32() % memShards]
+}
+
+func (sh *memShard) remove(uuid string) {
+    if entity, ok := sh.lookups[uuid]; ok {
+        delete(sh.lookups, entity.uuid)
+        sh.lru.Remove(entity.e)
+        sh.size -= int64(entity.data.Cap())
+    }
+}
+
+// shrink evicts least recently used entries of shard until it fits its capacity, shard must be locked
+func (m *memCache) shrink(sh *memShard) {
+    for sh.size > sh.capacity {
+        entity := sh.lru.Back().Value.(*memEntity)
+        logger.Debug("mcache cls", zap.Int64("cap", sh.capacity), zap.Int64("size", sh.size), zap.String("uuid", entity.uuid))
+        sh.remove(entity.uuid)
+        atomic.AddInt64(&m.evictions, 1)
+        atomic.AddInt64(&m.evicted, int64(entity.data.Cap()))
     }
 }
 
+func (m *memCache) drop(uuid string) {
+    sh := m.shard(uuid)
+    sh.Lock()
+    defer sh.Unlock()
+    sh.remove(uuid)
+}
+
 func (m *memCache) put(uuid string, data *bytes.Buffer) {
-    m.Lock()
-    defer m.Unlock()
-    m.p++
+    atomic.AddInt64(&m.p, 1)
     logger.Debug("mcache", zap.String("put", uuid), zap.Int("size", data.Len()), zap.Uintptr("ptr", uintptr(unsafe.Pointer(data))))
-    m.remove(uuid) /* clean up old one */
+    sh := m.shard(uuid)
+    sh.Lock()
+    defer sh.Unlock()
+    sh.remove(uuid) /* clean up old one */
+    if int64(data.Cap()) > sh.capacity {
+        atomic.AddInt64(&m.declined, 1) /* larger than share of a shard */
+        return
+    }
     entity := &memEntity{uuid: uuid, data: data, size: int64(data.Len()), ts: time.Now().UnixNano()}
-    m.lookups[uuid] = entity
-    m.library = append(m.library, entity)
-    m.size += int64(data.Cap())
-    if m.capacity < len(m.library) {
-        for i := 0; i < len(m.library); i++ {
-            entity := m.library[i]
-            if m.capacity < len(m.library) {
-                logger.Debug("mcache cls", zap.Int("cap", m.capacity), zap.Int("len", len(m.library)))
-                delete(m.lookups, entity.uuid)
-                m.library = append(m.library[:i], m.library[i+1:]...)
-                m.size -= int64(entity.data.Cap())
-                i--
-            } else { break }
+    entity.e = sh.lru.PushFront(entity)
+    sh.lookups[uuid] = entity
+    sh.size += int64(data.Cap())
+    m.shrink(sh)
+}
+
+// preload caches data of a key not cached yet without evicting live entries, hit restores its previous hit count
+func (m *memCache) preload(uuid string, data *bytes.Buffer, hit int) bool {
+    sh := m.shard(uuid)
+    sh.Lock()
+    defer sh.Unlock()
+    if _, ok := sh.lookups[uuid]; ok {return true}
+    if sh.size + int64(data.Cap()) > sh.capacity {return false}
+    entity := &memEntity{uuid: uuid, data: data, size: int64(data.Len()), ts: time.Now().UnixNano(), hit: hit}
+    entity.e = sh.lru.PushBack(entity) /* keys are preloaded hottest first */
+    sh.lookups[uuid] = entity
+    sh.size += int64(data.Cap())
+    return true
+}
+
+// hotKey is a cached key with its hit count, persisted for warming up memory cache after restart
+type hotKey struct {
+    Key  string `json:"k"`
+    Hits int    `json:"h"`
+}
+
+// hot lists cached keys, the most hit first
+func (m *memCache) hot() []hotKey {
+    var keys []hotKey
+    for i := range m.shards {
+        sh := &m.shards[i]
+        sh.Lock()
+        for e := sh.lru.Front(); e != nil; e = e.Next() {
+            entity := e.Value.(*memEntity)
+            keys = append(keys, hotKey{Key: entity.uuid, Hits: entity.hit})
         }
+        sh.Unlock()
+    }
+    sort.SliceStable(keys, func(i, j int) bool { return keys[i].Hits > keys[j].Hits })
+    return keys
+}
+
+// usage sums entries and bytes held by all shards
+func (m *memCache) usage() (int64, int64) {
+    entries, size := int64(0), int64(0)
+    for i := range m.shards {
+        sh := &m.shards[i]
+        sh.Lock()
+        entries += int64(sh.lru.Len())
+        size += sh.size
+        sh.Unlock()
     }
+    return entries, size
 }
 
 func (m *memCache) stat() {
     for {
-        m.RLock()
-        var size int64
-        for i := 0; i < len(m.library); i++ {
-            entity := m.library[i]
-            size += int64(entity.data.Cap())
-        }
-        m.RUnlock()
-        logger.Debug("mcache", zap.Int("library", len(m.library)),
-            zap.Int("lookups", len(m.lookups)),
+        entries, size := m.usage()
+        g, n := atomic.LoadInt64(&m.g), atomic.LoadInt64(&m.n)
+        logger.Debug("mcache", zap.Int64("library", entries),
             zap.Int64("size", size),
-            zap.Int("get", mcache.core.g),
-            zap.Float64("gpt", float64(mcache.core.g) / float64(mcache.core.n)),
-            zap.Int("put", mcache.core.p))
+            zap.Int64("get", g),
+            zap.Float64("gpt", float64(g) / float64(n)),
+            zap.Int64("put", atomic.LoadInt64(&m.p)))
         time.Sleep(5 * time.Second)
     }
 }
 
+func (m *memCache) stats() map[string]int64 {
+    entries, size := m.usage()
+    n, g := atomic.LoadInt64(&m.n), atomic.LoadInt64(&m.g)
+    return map[string]int64{
+        "capacity": atomic.LoadInt64(&m.capacity),
+        "size": size,
+        "entries": entries,
+        "lookups": n,
+        "hits": g,
+        "misses": n - g,
+        "puts": atomic.LoadInt64(&m.p),
+        "evictions": atomic.LoadInt64(&m.evictions),
+        "evicted": atomic.LoadInt64(&m.evicted),
+        "declined": atomic.LoadInt64(&m.declined),
+    }
+}
+
+// get returns a reader over cached data, a hit makes entry the most recently used of its shard
 func (m *memCache) get(uuid string) (*bytes.Buffer, error) {
-    m.RLock()
-    defer m.RUnlock()
-    m.n++
-    if entity, ok := m.lookups[uuid]; ok {
+    atomic.AddInt64(&m.n, 1)
+    sh := m.shard(uuid)
+    sh.Lock()
+    defer sh.Unlock()
+    if entity, ok := sh.lookups[uuid]; ok {
         entity.hit++
-        m.g++
+        atomic.AddInt64(&m.g, 1)
+        sh.lru.MoveToFront(entity.e)
         logger.Debug("mcache", zap.String("get", uuid),
             zap.Uintptr("ptr", uintptr(unsafe.Pointer(entity.data))),
             zap.Int("size", entity.data.Len()),
@@ -158,7 +293,6 @@ func (m *memCache) get(uuid string) (*bytes.Buffer, error) {
 
 var mcache struct {
     core   memCache
-    limit  int64
     errors struct {
         unavailable error
         cacherr     error
@@ -166,14 +300,14 @@ var mcache struct {
 }
 
 func init() {
-    mcache.limit = 2 << 20 // 2M
     mcache.errors.unavailable = errors.New("not available for caching")
     mcache.errors.cacherr = errors.New("cache error")
-    mcache.core.lookups = make(map[string]*memEntity)
+    mcache.core.init()
 }
 
-func Open(name string, uuid string) (*File, error) {
-    if mcache.core.capacity > 0 {
+// Open opens file for reading, admit decides by file size whether its content is kept in memory cache once read through
+func Open(name string, uuid string, admit func(int64) bool) (*File, error) {
+    if mcache.core.enabled() {
         if data, err := mcache.core.get(uuid); err == nil {
             return &File{m: data, uuid: uuid, size: int64(data.Len()), c: true}, nil
         }
@@ -183,8 +317,8 @@ func Open(name string, uuid string) (*File, error) {
     f := &File{f: file, name: name, uuid: uuid}
     if s, err := file.Stat(); err == nil {
         f.size = s.Size()
-        if mcache.core.capacity > 0 && s.Size() < mcache.limit {
-            f.m = bytes.NewBuffer(make([]byte, 0, s.Size()))
+        if admit(s.Size()) {
+            f.m = bytes.NewBuffer(getBuffer(int(s.Size()))[:0])
         }
     } else {
         file.Close()
@@ -193,12 +327,12 @@ func Open(name string, uuid string) (*File, error) {
     return f, nil
 }
 
-func NewFile(name string, uuid string, size int64) (*File, error) {
-    file, err := os.OpenFile(name, os.O_CREATE | os.O_WRONLY, 0700)
+func NewFile(name string, uuid string, size int64, admit bool) (*File, error) {
+    file, err := os.OpenFile(name, os.O_CREATE | os.O_RDWR, 0700) /* puts received straight into file are read back for digest */
     if err != nil {return nil, err}
     f := &File{f: file, name: name, uuid: uuid, size: size}
-    if mcache.core.capacity > 0 && size < mcache.limit {
-        f.m = bytes.NewBuffer(make([]byte, 0, size))
+    if admit {
+        f.m = bytes.NewBuffer(getBuffer(int(size))[:0])
     }
     return f, nil
 }
@@ -0,0 +1,47 @@
+package server
+
+import (
+    "bytes"
+    "fmt"
+    "math/rand"
+    "sync"
+    "testing"
+)
+
+func TestMemCacheConcurrent(t *testing.T) {
+    mcache.core.resize(memShards << 16)
+    defer mcache.core.resize(0)
+    var wg sync.WaitGroup
+    for g := 0; g < 16; g++ {
+        wg.Add(1)
+        go func(seed int64) {
+            defer wg.Done()
+            r := rand.New(rand.NewSource(seed))
+            for i := 0; i < 2000; i++ {
+                key := fmt.Sprintf("v/%064d/%d", r.Intn(256), 0)
+                switch r.Intn(3) {
+                case 0: mcache.core.put(key, bytes.NewBuffer(make([]byte, r.Intn(16<<10))))
+                case 1: mcache.core.get(key)
+                default: mcache.core.drop(key)
+                }
+            }
+        }(int64(g))
+    }
+    wg.Wait()
+    for i := range mcache.core.shards {
+        sh := &mcache.core.shards[i]
+        size := int64(0)
+        for e := sh.lru.Front(); e != nil; e = e.Next() { size += int64(e.Value.(*memEntity).data.Cap()) }
+        if size != sh.size || sh.size > sh.capacity || len(sh.lookups) != sh.lru.Len() {
+            t.Fatalf("shard %d size %d accounted %d capacity %d lookups %d lru %d", i, size, sh.size, sh.capacity, len(sh.lookups), sh.lru.Len())
+        }
+    }
+}
+
+func TestAdmitShardShare(t *testing.T) {
+    mcache.core.resize(32 << 20)
+    defer mcache.core.resize(0)
+    s := &CacheServer{CacheMax: 64 << 20, CachePut: true}
+    if !s.admit(0, 512 << 10, 0, true) {t.Fatal("file within shard share declined")}
+    if s.admit(0, 2 << 20, 0, true) {t.Fatal("file above shard share admitted")}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+    "compress/gzip"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "go.uber.org/zap"
+    "io"
+    "net"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type parentStats struct {
+    hits      int64
+    misses    int64
+    failures  int64
+    forwarded int64
+    rejected  int64 // forwards failed or dropped
+}
+
+// parentConn is a connection to parent or another gocache server speaking client protocol in namespace version
+type parentConn struct {
+    c       net.Conn
+    s       *Stream
+    addr    string
+    secret  string
+    version string
+    reused  bool
+    b       [64]byte
+}
+
+// parents keeps idle connections to gocache servers per address, secret and namespace, so that a connection is reused with the secret it connected with
+type parents struct {
+    idle map[string][]*parentConn
+    sync.Mutex
+}
+
+type forward struct {
+    version string
+    uuid    string
+    t       int
+}
+
+func (s *CacheServer) parentTimeout() time.Duration {
+    if s.ParentTimeout > 0 {return s.ParentTimeout}
+    return 5 * time.Second
+}
+
+// dial returns an idle connection to addr of namespace version or connects a new one
+func (s *CacheServer) dial(addr string, secret string, version string) (*parentConn, error) {
+    key := addr + "/" + secret + "/" + version
+    s.parents.Lock()
+    if v := s.parents.idle[key]; len(v) > 0 {
+        pc := v[len(v)-1]
+        s.parents.idle[key] = v[:len(v)-1]
+        s.parents.Unlock()
+        pc.reused = true
+        return pc, nil
+    }
+    s.parents.Unlock()
+    c, err := net.DialTimeout("tcp", addr, s.parentTimeout())
+    if err != nil {return nil, err}
+    pc := &parentConn{c: c, s: &Stream{Rwp: c}, addr: addr, secret: secret, version: version}
+    c.SetDeadline(time.Now().Add(s.parentTimeout()))
+    if err := pc.handshake(secret); err != nil {
+        c.Close()
+        return nil, err
+    }
+    return pc, nil
+}
+
+func (pc *parentConn) handshake(secret string) error {
+    b := pc.b[:]
+    if err := pc.s.WriteString(b, secret); err != nil {return err}
+    if err := pc.s.WriteString(b, pc.version); err != nil {return err}
+    if ver, err := pc.s.ReadString(b); err != nil {return err} else if ver != pc.version {
+        return fmt.Errorf("parent version not match: %s != %s", ver, pc.version)
+    }
+    b[0] = 'n'
+    binary.BigEndian.PutUint32(b[1:], FeaturePutAck) /* entries are pulled decoded so that they stream to every client */
+    if err := pc.s.Write(b, 5); err != nil {return err}
+    if err := pc.s.Read(b, 5); err != nil {return err}
+    if b[0] != 'n' || binary.BigEndian.Uint32(b[1:]) & FeaturePutAck == 0 {return fmt.Errorf("parent negotiate failed: %c", b[0])}
+    return nil
+}
+
+// recycle keeps pc for later requests of its address, secret and namespace
+func (s *CacheServer) recycle(pc *parentConn) {
+    pc.c.SetDeadline(time.Time{})
+    key := pc.addr + "/" + pc.secret + "/" + pc.version
+    s.parents.Lock()
+    defer s.parents.Unlock()
+    if s.parents.idle == nil { s.parents.idle = map[string][]*parentConn{} }
+    if len(s.parents.idle[key]) >= 8 {
+        pc.c.Close()
+        return
+    }
+    s.parents.idle[key] = append(s.parents.idle[key], pc)
+}
+
+// request writes command cmd of entity uuid and type t
+func (pc *parentConn) request(cmd byte, uuid string, t int) error {
+    b := pc.b[:]
+    b[0] = cmd
+    if _, err := hex.Decode(b[1:33], []byte(uuid)); err != nil {return err}
+    binary.BigEndian.PutUint32(b[33:], uint32(t))
+    return pc.s.Write(b, 37)
+}
+
+// parentBody reads entry body from parent, its connection is recycled once body is read through
+type parentBody struct {
+    s    *CacheServer
+    pc   *parentConn
+    left int64
+}
+
+func (p *parentBody) Read(b []byte) (int, error) {
+    if p.left <= 0 {return 0, io.EOF}
+    if int64(len(b)) > p.left { b = b[:p.left] }
+    p.pc.c.SetReadDeadline(time.Now().Add(p.s.parentTimeout()))
+    n, err := p.pc.c.Read(b)
+    p.left -= int64(n)
+    if err == io.EOF && p.left > 0 { err = io.ErrUnexpectedEOF }
+    return n, err
+}
+
+func (p *parentBody) Close() error {
+    if p.left == 0 {
+        p.s.recycle(p.pc)
+        return nil
+    }
+    return p.pc.c.Close()
+}
+
+// upstream joins fetch flight of an entry missing locally, which is pulled from parent server in background once its leader joins,
+// so that readers block in ready instead of send loop, it returns nil when entry can't be stored
+func (s *CacheServer) upstream(version, uuid string, t int) *flightReader {
+    r := s.place(uuid)
+    if r == nil {return nil}
+    f, leader := s.fetches.join(metaKey(version, uuid, t))
+    fr := f.reader()
+    if leader { go s.pull(f, r, &Meta{Version: version, Uuid: uuid, Type: t}) } else { f.release() }
+    return fr
+}
+
+// remote gets entry of version, uuid and t from gocache server at addr, a miss returns os.ErrNotExist
+func (s *CacheServer) remote(addr string, secret string, version string, uuid string, t int) (*parentBody, error) {
+    var pc *parentConn
+    var err error
+    for retry := true; retry; {
+        if pc, err = s.dial(addr, secret, version); err != nil {break}
+        pc.c.SetDeadline(time.Now().Add(s.parentTimeout()))
+        if err = pc.request('g', uuid, t); err == nil { err = pc.s.Read(pc.b[:], 1+32+4+8) }
+        if err == nil {break}
+        pc.c.Close()
+        retry = pc.reused /* idle connection may have been closed by server meanwhile */
+    }
+    if err != nil {return nil, err}
+    b := pc.b[:]
+    if b[0] != '+' {
+        s.recycle(pc)
+        return nil, os.ErrNotExist
+    }
+    return &parentBody{s: s, pc: pc, left: int64(binary.BigEndian.Uint64(b[37:]))}, nil
+}
+
+// pull requests entry of meta from parent server for fetch flight f, a miss or any failure of parent lands f with an error
+func (s *CacheServer) pull(f *flight, r *root, meta *Meta) {
+    u := fmt.Sprintf("gocache://%s/%s/%s/%d", s.Parent, meta.Version, meta.Uuid, meta.Type)
+    body, err := s.remote(s.Parent, s.ParentSecret, meta.Version, meta.Uuid, meta.Type)
+    if err == os.ErrNotExist {
+        atomic.AddInt64(&s.parentStats.misses, 1)
+        s.fetches.land(f, err)
+        return
+    }
+    if err != nil {
+        atomic.AddInt64(&s.parentStats.failures, 1)
+        logger.Warn("parent get err", zap.String("url", u), zap.Error(err))
+        s.fetches.land(f, err)
+        return
+    }
+    atomic.AddInt64(&s.parentStats.hits, 1)
+    s.spool(f, u, body, body.left, r, meta)
+}
+
+// relay queues a committed put for forwarding to parent server, dropping it when queue is full
+func (s *CacheServer) relay(meta *Meta) {
+    select {
+    case s.forwards <- &forward{version: meta.Version, uuid: meta.Uuid, t: meta.Type}:
+    default:
+        atomic.AddInt64(&s.parentStats.rejected, 1)
+        logger.Warn("parent forward dropped", zap.String("uuid", meta.Uuid), zap.Int("type", meta.Type))
+    }
+}
+
+// forwarder puts queued entries to parent server
+func (s *CacheServer) forwarder() {
+    buf := getBuffer(64<<10)
+    defer putBuffer(buf)
+    for v := range s.forwards {
+        if err := s.forward(v, buf); err != nil {
+            atomic.AddInt64(&s.parentStats.rejected, 1)
+            logger.Warn("parent forward err", zap.String("uuid", v.uuid), zap.Int("type", v.t), zap.Error(err))
+        } else { atomic.AddInt64(&s.parentStats.forwarded, 1) }
+    }
+}
+
+func (s *CacheServer) forward(v *forward, buf []byte) error {
+    r, m, ok := s.locate(v.version, v.uuid, v.t)
+    if !ok {return os.ErrNotExist}
+    file, err := os.Open(r.entry(&m))
+    if err != nil {return err}
+    defer file.Close()
+    var in io.Reader = file
+    if m.Encoding != "" {
+        gz, err := gzip.NewReader(file)
+        if err != nil {return err}
+        in = gz
+    }
+    pc, err := s.dial(s.Parent, s.ParentSecret, v.version)
+    if err != nil {return err}
+    pc.c.SetDeadline(time.Now().Add(s.parentTimeout()))
+    if err := pc.request('p', v.uuid, v.t); err != nil {
+        pc.c.Close()
+        return err
+    }
+    binary.BigEndian.PutUint64(pc.b[:], uint64(m.Size))
+    if err := pc.s.Write(pc.b[:], 8); err != nil {
+        pc.c.Close()
+        return err
+    }
+    for sent := int64(0); sent < m.Size; {
+        num := int64(len(buf))
+        if m.Size - sent < num { num = m.Size - sent }
+        if _, err := io.ReadFull(in, buf[:num]); err != nil {
+            pc.c.Close() /* body is cut short, connection is unusable */
+            return err
+        }
+        pc.c.SetDeadline(time.Now().Add(s.parentTimeout()))
+        if err := pc.s.Write(buf, int(num)); err != nil {
+            pc.c.Close()
+            return err
+        }
+        sent += num
+    }
+    b := pc.b[:]
+    if err := pc.s.Read(b, 1+32+4+1); err != nil {
+        pc.c.Close()
+        return err
+    }
+    s.recycle(pc)
+    if b[0] != 'p' || b[37] != '+' {return fmt.Errorf("parent put failed: %c%c", b[0], b[37])}
+    return nil
+}
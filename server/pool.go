@@ -0,0 +1,70 @@
+package server
+
+import (
+    "sort"
+    "sync"
+    "sync/atomic"
+)
+
+// size classes step by a quarter of each power of two from 4KB to 64MB, so a pooled buffer wastes at most a fifth of itself
+var classes []int
+
+type bufferPool struct {
+    pools    []sync.Pool
+    gets     int64
+    hits     int64
+    puts     int64
+    oversize int64
+}
+
+var pool bufferPool
+
+func init() {
+    for k := uint(12); k < 26; k++ {
+        for q := 4; q < 8; q++ { classes = append(classes, q << k / 4) }
+    }
+    classes = append(classes, 1 << 26)
+    pool.pools = make([]sync.Pool, len(classes))
+}
+
+// getBuffer returns a buffer of length size, taken from the pool of the smallest class that holds it
+func getBuffer(size int) []byte {
+    atomic.AddInt64(&pool.gets, 1)
+    i := sort.SearchInts(classes, size)
+    if i == len(classes) {
+        atomic.AddInt64(&pool.oversize, 1)
+        return make([]byte, size)
+    }
+    if v := pool.pools[i].Get(); v != nil {
+        atomic.AddInt64(&pool.hits, 1)
+        return (*v.(*[]byte))[:size]
+    }
+    return make([]byte, size, classes[i])
+}
+
+// classOf returns capacity of the buffer getBuffer returns for size
+func classOf(size int) int {
+    i := sort.SearchInts(classes, size)
+    if i == len(classes) {return size}
+    return classes[i]
+}
+
+// putBuffer recycles a buffer obtained by getBuffer, buffers of other capacities are left to GC
+func putBuffer(b []byte) {
+    i := sort.SearchInts(classes, cap(b))
+    if i == len(classes) || classes[i] != cap(b) {return}
+    atomic.AddInt64(&pool.puts, 1)
+    b = b[:0]
+    pool.pools[i].Put(&b)
+}
+
+func (p *bufferPool) stats() map[string]int64 {
+    gets, hits := atomic.LoadInt64(&p.gets), atomic.LoadInt64(&p.hits)
+    return map[string]int64{
+        "gets": gets,
+        "hits": hits,
+        "misses": gets - hits,
+        "puts": atomic.LoadInt64(&p.puts),
+        "oversize": atomic.LoadInt64(&p.oversize),
+    }
+}
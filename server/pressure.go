@@ -0,0 +1,66 @@
+package server
+
+import (
+    "go.uber.org/zap"
+    "io/ioutil"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+type memStats struct {
+    limit    int64
+    heap     int64
+    pressure int64 // heap per mille of limit
+    shrinks  int64
+}
+
+// cgroupLimit reads memory limit of container from cgroup v2 or v1, returning 0 when unlimited or unknown
+func cgroupLimit() int64 {
+    for _, name := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+        b, err := ioutil.ReadFile(name)
+        if err != nil {continue}
+        v := strings.TrimSpace(string(b))
+        if v == "max" {return 0}
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n >= 1 << 60 {return 0} /* v1 reports unlimited as a huge page aligned number */
+        return n
+    }
+    return 0
+}
+
+// budget adapts memory cache capacity so that heap stays below MemHigh of memory limit, shrinking at once and growing back gradually
+func (s *CacheServer) budget() {
+    if s.CacheCap <= 0 {return}
+    limit := s.MemLimit
+    if limit < 0 { limit = cgroupLimit() }
+    if limit <= 0 {return}
+    high := s.MemHigh
+    if high <= 0 || high > 1 { high = 0.8 }
+    atomic.StoreInt64(&s.memStats.limit, limit)
+    logger.Info("memory budget", zap.Int64("limit", limit), zap.Float64("high", high), zap.Int64("cap", s.CacheCap))
+
+    var ms runtime.MemStats
+    s.every(time.Second, func() {
+        runtime.ReadMemStats(&ms)
+        heap := int64(ms.HeapAlloc)
+        _, cached := mcache.core.usage()
+        current := atomic.LoadInt64(&mcache.core.capacity)
+        target := int64(float64(limit) * high) - (heap - cached)
+        if target > s.CacheCap { target = s.CacheCap }
+        if target < 0 { target = 0 }
+        if target > current { /* grow by a tenth of cap at most to avoid oscillating */
+            if step := s.CacheCap / 10; target > current + step { target = current + step }
+        }
+        atomic.StoreInt64(&s.memStats.heap, heap)
+        atomic.StoreInt64(&s.memStats.pressure, heap * 1000 / limit)
+        if target == current {return}
+        if target < current {
+            atomic.AddInt64(&s.memStats.shrinks, 1)
+            logger.Warn("memory pressure", zap.Int64("heap", heap), zap.Int64("limit", limit), zap.Int64("cached", cached), zap.Int64("budget", target))
+        }
+        mcache.core.resize(target)
+    })
+}
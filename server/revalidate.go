@@ -0,0 +1,97 @@
+package server
+
+import (
+    "go.uber.org/zap"
+    "sync/atomic"
+    "time"
+)
+
+type revalidateStats struct {
+    checks    int64
+    unchanged int64
+    replaced  int64
+    failures  int64
+}
+
+// validators records url of entry and upstream validators of src, which make later revalidation conditional
+func validators(m *Meta, u string, src *Source) {
+    m.Url = u
+    m.ETag, m.Modified = "", ""
+    if len(src.ETag) + len(src.Modified) <= 1<<10 { m.ETag, m.Modified = src.ETag, src.Modified } /* oversized ones would bloat index records */
+    m.Validated = time.Now().UnixNano()
+}
+
+// age returns time since url-sourced entry was last validated against upstream
+func age(m *Meta) time.Duration {
+    ts := m.Validated
+    if ts == 0 { ts = m.Created }
+    return time.Since(time.Unix(0, ts))
+}
+
+// aged reports whether url-sourced entry m was validated longer than RevalidateAge ago
+func (s *CacheServer) aged(m *Meta) bool {
+    return m.Url != "" && s.RevalidateAge > 0 && age(m) > s.RevalidateAge
+}
+
+// stale reports whether url-sourced entry m is aged and not checked within RevalidateAge, which gets serve while it is revalidated in background,
+// so that revalidation failing upstream is retried once per RevalidateAge instead of on every get
+func (s *CacheServer) stale(m *Meta) bool {
+    return s.aged(m) && time.Since(time.Unix(0, m.Checked)) > s.RevalidateAge
+}
+
+// expired reports whether url-sourced entry m is aged beyond RevalidateStale, which url gets fetch again before serving
+func (s *CacheServer) expired(m *Meta) bool {
+    return s.aged(m) && s.RevalidateStale > 0 && age(m) > s.RevalidateAge + s.RevalidateStale
+}
+
+// revalidate fetches url-sourced entry m conditionally, which is marked fresh when upstream has not changed and replaced otherwise,
+// content of fetchers without validators, such as gocache, is fetched again and counts as changed only when its digest differs
+func (s *CacheServer) revalidate(r *root, m Meta) {
+    key := m.Key()
+    if _, busy := s.revalidating.LoadOrStore(key, r); busy {return}
+    defer s.revalidating.Delete(key)
+    atomic.AddInt64(&s.revalidateStats.checks, 1)
+    src, err := s.open(m.Url, &m)
+    if err == ErrNotModified {
+        r.index.update(m.Version, m.Uuid, m.Type, func(m *Meta) { m.Validated = time.Now().UnixNano() })
+        atomic.AddInt64(&s.revalidateStats.unchanged, 1)
+        logger.Debug("revalidate unchanged", zap.String("url", m.Url))
+        return
+    }
+    if err != nil {
+        s.unchecked(r, &m, err)
+        return
+    }
+    dst := s.place(m.Uuid)
+    if dst == nil {
+        src.Body.Close()
+        return
+    }
+    f, leader := s.fetches.join(key)
+    if !leader { /* a url get is fetching it already */
+        f.release()
+        src.Body.Close()
+        return
+    }
+    meta := &Meta{Version: m.Version, Uuid: m.Uuid, Type: m.Type}
+    validators(meta, m.Url, src)
+    s.spool(f, m.Url, src.Body, src.Size, dst, meta)
+    if err := f.wait(); err != nil {
+        s.unchecked(r, &m, err)
+        return
+    }
+    if meta.Digest == m.Digest {
+        atomic.AddInt64(&s.revalidateStats.unchanged, 1)
+        logger.Debug("revalidate unchanged", zap.String("url", m.Url), zap.String("digest", meta.Digest))
+        return
+    }
+    atomic.AddInt64(&s.revalidateStats.replaced, 1)
+    logger.Debug("revalidate changed", zap.String("url", m.Url), zap.String("etag", meta.ETag), zap.String("digest", meta.Digest))
+}
+
+// unchecked records failed revalidation of m, gets keep serving it and retry once RevalidateAge passes again
+func (s *CacheServer) unchecked(r *root, m *Meta, err error) {
+    r.index.update(m.Version, m.Uuid, m.Type, func(m *Meta) { m.Checked = time.Now().UnixNano() })
+    atomic.AddInt64(&s.revalidateStats.failures, 1)
+    logger.Warn("revalidate", zap.String("url", m.Url), zap.Error(err))
+}
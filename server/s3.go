@@ -0,0 +1,82 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+)
+
+// s3Fetcher fills entries from S3 compatible object stores addressed as s3://bucket/key through path style requests to S3Endpoint.
+// Requests are signed with access key as user and secret key as password of credential matching the url,
+// or with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and are anonymous when neither is given.
+type s3Fetcher struct {
+    s *CacheServer
+}
+
+func (f *s3Fetcher) Fetch(u *url.URL, m *Meta) (*Source, error) {
+    endpoint := f.s.S3Endpoint
+    if endpoint == "" { endpoint = "https://s3.amazonaws.com" }
+    target, err := url.Parse(endpoint)
+    if err != nil {return nil, err}
+    key := strings.TrimPrefix(u.Path, "/")
+    if u.Host == "" || key == "" {return nil, fmt.Errorf("s3 url malformed: %s", u)}
+    target.Path = strings.TrimSuffix(target.Path, "/") + "/" + u.Host + "/" + key
+    target.RawPath = s3Escape(target.Path)
+    access, secret, token := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+    if c := f.s.credentials.match(u); c != nil && c.User != "" { access, secret, token = c.User, c.Password, "" }
+    header := conditional(m)
+    if access != "" {
+        region := f.s.S3Region
+        if region == "" { region = "us-east-1" }
+        sign(header, target, region, access, secret, token, time.Now().UTC())
+    }
+    rsp, err := f.s.download(target.String(), header, nil)
+    if err != nil {return nil, err}
+    return httpSource(rsp)
+}
+
+// s3Escape encodes path as canonical uri of signature v4, which leaves only unreserved characters and slashes as they are
+func s3Escape(path string) string {
+    var b strings.Builder
+    for i := 0; i < len(path); i++ {
+        c := path[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+            b.WriteByte(c)
+        } else { fmt.Fprintf(&b, "%%%02X", c) }
+    }
+    return b.String()
+}
+
+func hmacSHA256(key []byte, v string) []byte {
+    h := hmac.New(sha256.New, key)
+    h.Write([]byte(v))
+    return h.Sum(nil)
+}
+
+// sign adds signature v4 authorization of an unsigned payload GET of target to header
+func sign(header http.Header, target *url.URL, region string, access string, secret string, token string, now time.Time) {
+    date := now.Format("20060102")
+    stamp := now.Format("20060102T150405Z")
+    header.Set("X-Amz-Date", stamp)
+    header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+    signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+    canonical := "host:" + target.Host + "\nx-amz-content-sha256:UNSIGNED-PAYLOAD\nx-amz-date:" + stamp + "\n"
+    if token != "" {
+        header.Set("X-Amz-Security-Token", token)
+        signed = append(signed, "x-amz-security-token")
+        canonical += "x-amz-security-token:" + token + "\n"
+    }
+    request := strings.Join([]string{http.MethodGet, target.EscapedPath(), target.RawQuery, canonical, strings.Join(signed, ";"), "UNSIGNED-PAYLOAD"}, "\n")
+    digest := sha256.Sum256([]byte(request))
+    scope := date + "/" + region + "/s3/aws4_request"
+    text := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+    key := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+secret), date), region), "s3"), "aws4_request")
+    header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        access, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSHA256(key, text))))
+}
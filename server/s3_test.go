@@ -0,0 +1,105 @@
+package server
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// verify checks signature v4 of r the way S3 does, rebuilding canonical request from what is received
+func verify(r *http.Request, secret string, region string) error {
+    auth := r.Header.Get("Authorization")
+    if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {return fmt.Errorf("authorization malformed: %s", auth)}
+    fields := map[string]string{}
+    for _, kv := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+        if i := strings.Index(kv, "="); i > 0 { fields[kv[:i]] = kv[i+1:] }
+    }
+    credential := strings.SplitN(fields["Credential"], "/", 2)
+    stamp := r.Header.Get("X-Amz-Date")
+    if len(credential) != 2 || len(stamp) < 8 {return fmt.Errorf("authorization malformed: %s", auth)}
+    scope := credential[1]
+    if scope != stamp[:8] + "/" + region + "/s3/aws4_request" {return fmt.Errorf("scope mismatch: %s", scope)}
+    signed := strings.Split(fields["SignedHeaders"], ";")
+    headers := ""
+    for _, h := range signed {
+        v := r.Header.Get(h)
+        if h == "host" { v = r.Host }
+        headers += h + ":" + strings.TrimSpace(v) + "\n"
+    }
+    for _, h := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+        if !strings.Contains(";" + fields["SignedHeaders"] + ";", ";" + h + ";") {return fmt.Errorf("%s not signed", h)}
+    }
+    request := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, headers, fields["SignedHeaders"], r.Header.Get("X-Amz-Content-Sha256")}, "\n")
+    digest := sha256.Sum256([]byte(request))
+    text := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+    key := []byte("AWS4" + secret)
+    for _, v := range strings.Split(scope, "/") {
+        h := hmac.New(sha256.New, key)
+        h.Write([]byte(v))
+        key = h.Sum(nil)
+    }
+    h := hmac.New(sha256.New, key)
+    h.Write([]byte(text))
+    if expect := hex.EncodeToString(h.Sum(nil)); !hmac.Equal([]byte(expect), []byte(fields["Signature"])) {
+        return fmt.Errorf("signature mismatch: %s != %s", fields["Signature"], expect)
+    }
+    return nil
+}
+
+func TestS3Fetcher(t *testing.T) {
+    const access, secret = "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+    content := []byte("object of bucket")
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if err := verify(r, secret, "eu-west-1"); err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+        if r.URL.EscapedPath() != "/bucket/dir/a%20b.bin" {
+            http.NotFound(w, r)
+            return
+        }
+        w.Header().Set("ETag", `"v1"`)
+        if r.Header.Get("If-None-Match") == `"v1"` {
+            w.WriteHeader(http.StatusNotModified)
+            return
+        }
+        w.Write(content)
+    }))
+    defer srv.Close()
+
+    s := &CacheServer{S3Endpoint: srv.URL, S3Region: "eu-west-1"}
+    s.registerFetchers()
+    c := &Credential{Match: "s3://bucket", User: access, Password: secret}
+    if err := c.init(); err != nil { t.Fatal(err) }
+    s.credentials = Credentials{c}
+    u := "s3://bucket/dir/a b.bin"
+    if _, err := s.open(u, nil); err == nil || !strings.Contains(err.Error(), "fetch not allowed") {
+        t.Fatalf("s3 fetched without a rule: %v", err)
+    }
+    if err := s.FetchAllow.Set("s3://bucket"); err != nil { t.Fatal(err) }
+    if _, err := s.open(u, nil); err == nil || !strings.Contains(err.Error(), "address not allowed") {
+        t.Fatalf("s3 endpoint on loopback dialed without a rule naming it: %v", err)
+    }
+    if err := s.FetchAllow.Set("127.0.0.1"); err != nil { t.Fatal(err) }
+    b, src, err := read(t, s, u, nil)
+    if err != nil || !bytes.Equal(b, content) || src.ETag != `"v1"` {
+        t.Fatalf("s3 fetch: %q %v", b, err)
+    }
+    if _, err := s.open(u, &Meta{ETag: src.ETag}); err != ErrNotModified {
+        t.Fatalf("s3 revalidate: %v", err)
+    }
+    if _, err := s.open("s3://bucket/dir/other.bin", nil); err == nil || !strings.Contains(err.Error(), "status 404") {
+        t.Fatalf("s3 missing object: %v", err)
+    }
+
+    c.Password = "wrong"
+    if _, err := s.open(u, nil); err == nil || !strings.Contains(err.Error(), "status 403") {
+        t.Fatalf("s3 accepted wrong signature: %v", err)
+    }
+}
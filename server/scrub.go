@@ -0,0 +1,107 @@
+package server
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "go.uber.org/zap"
+    "io"
+    "os"
+    "path"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+type scrubStats struct {
+    passes  int64
+    files   int64
+    size    int64
+    corrupt int64
+    last    int64
+}
+
+// scrub walks stored entries continuously, re-hashing them no faster than ScrubRate bytes per second
+func (s *CacheServer) scrub() {
+    if s.ScrubRate <= 0 {return}
+    buf := make([]byte, 64<<10)
+    for {
+        ts := time.Now()
+        files, corrupt := 0, 0
+        for _, r := range s.roots {
+            for _, m := range r.index.list("") {
+                if s.stopping() {return}
+                ok, err := s.check(r, &m, buf)
+                if err != nil {continue}
+                files++
+                if !ok {
+                    corrupt++
+                    s.quarantine(r, &m)
+                }
+            }
+        }
+        atomic.AddInt64(&s.scrubStats.passes, 1)
+        atomic.StoreInt64(&s.scrubStats.last, time.Now().UnixNano())
+        logger.Info("scrub done", zap.Int("files", files), zap.Int("corrupt", corrupt), zap.Duration("elapse", time.Since(ts)))
+        select {
+        case <-s.quit: return
+        case <-time.After(s.ScrubInterval):
+        }
+    }
+}
+
+// check re-hashes entry against its digest, entries without digest get one recorded
+func (s *CacheServer) check(r *root, m *Meta, buf []byte) (bool, error) {
+    name := r.entry(m)
+    file, err := os.Open(name)
+    if err != nil {return false, err}
+    defer file.Close()
+
+    h := sha256.New()
+    ts := time.Now()
+    size := int64(0)
+    for {
+        if s.stopping() {return false, errClosed}
+        n, err := file.Read(buf)
+        h.Write(buf[:n])
+        size += int64(n)
+        if expect := time.Duration(size * int64(time.Second) / s.ScrubRate); expect > time.Since(ts) {
+            time.Sleep(expect - time.Since(ts))
+        }
+        if err == io.EOF {break}
+        if err != nil {return false, err}
+    }
+    atomic.AddInt64(&s.scrubStats.files, 1)
+    atomic.AddInt64(&s.scrubStats.size, size)
+
+    digest := hex.EncodeToString(h.Sum(nil))
+    current, ok := r.index.get(m.Version, m.Uuid, m.Type)
+    if !ok || current.Created != m.Created {return false, os.ErrNotExist} /* replaced or removed while hashing */
+    if current.Digest == "" {
+        current.Digest = digest
+        if current.Encoding != "" {current.Stored = size} else {current.Size = size}
+        r.index.put(&current)
+        return true, nil
+    }
+    if size == current.Disk() && digest == current.Digest {return true, nil}
+    logger.Error("scrub corrupt", zap.String("file", name), zap.Int64("size", size), zap.Int64("expect", current.Disk()), zap.String("digest", digest), zap.String("recorded", current.Digest))
+    return false, nil
+}
+
+// quarantine moves a corrupt entry out of storage so that it is never served again
+func (s *CacheServer) quarantine(r *root, m *Meta) {
+    atomic.AddInt64(&s.scrubStats.corrupt, 1)
+    name := r.entry(m)
+    dir := path.Join(r.quarantined, m.Version)
+    if err := s.mkdir(dir); err != nil {
+        logger.Error("quarantine", zap.String("dir", dir), zap.Error(err))
+        return
+    }
+    dst := path.Join(dir, m.Uuid + "." + strconv.Itoa(m.Type) + "." + strconv.FormatInt(time.Now().Unix(), 10))
+    if err := os.Rename(name, dst); err != nil && !os.IsNotExist(err) {
+        logger.Error("quarantine", zap.String("file", name), zap.Error(err))
+        return
+    }
+    r.index.remove(m)
+    mcache.core.drop(m.Key())
+    logger.Warn("quarantine", zap.String("file", name), zap.String("dst", dst))
+}
@@ -2,20 +2,23 @@ package server
 
 import (
     "bytes"
+    "compress/gzip"
+    "crypto/sha256"
     "encoding/binary"
     "encoding/hex"
     "fmt"
-    "github.com/djherbis/times"
     "go.uber.org/zap"
     "go.uber.org/zap/zapcore"
+    "hash"
     "io"
     "math/rand"
     "net"
     "net/http"
     "os"
     "path"
-    "path/filepath"
     "strconv"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
@@ -30,32 +33,14 @@ type Entity struct {
 type Context struct {
     Entity
     command byte
-    file *WebFile
-}
-
-type WebFile struct {
-    body io.ReadCloser
-    size int64
-    file *os.File
-    name string
-}
-
-func (f *WebFile) Read(p []byte) (int, error) {
-    n, err := f.body.Read(p)
-    t := 0
-    for t < n { if i, err := f.file.Write(p[t:n]); err != nil {return n, err} else {t+=i} }
-    return n, err
-}
-
-func (f *WebFile) Write(p []byte) (int, error) {
-    return len(p), nil
-}
-
-func (f *WebFile) Close() error {
-    defer os.Rename(f.file.Name(), f.name)
-    defer f.file.Close()
-    logger.Debug("close web file")
-    return f.body.Close()
+    flight *flightReader
+    cleaned chan *CleanReport /* report of clean pass running in background, nil when busy */
+    filter *ArchiveFilter
+    archive *ArchiveReport
+    job     *JobStatus
+    denied bool
+    features uint32
+    status byte
 }
 
 type Stream struct {
@@ -130,28 +115,153 @@ type CacheServer struct {
     Port      int
     Path      string
     LogLevel  int
-    CacheCap  int
+    CacheCap  int64
+    CacheMin  int64
+    CacheMax  int64
+    CacheHits int
+    CachePut  bool
+    CacheRules AdmissionRules
+    MemLimit  int64
+    MemHigh   float64
+    WarmInterval time.Duration
+    WarmRate  int64
+    ZeroCopy  bool
+    PutWait   time.Duration
+    PutStream bool
+    Parent    string
+    ParentSecret string
+    ParentPut bool
+    ParentTimeout time.Duration
+    FetchTimeout  time.Duration
+    FetchRetries  int
+    FetchMax      int64
+    FetchAllow    FetchRules
+    FetchCredentials string
+    FetchFiles    string
+    S3Endpoint    string
+    S3Region      string
+    RevalidateAge time.Duration
+    RevalidateStale time.Duration
+    JobWorkers    int
+    JobQueue      int
     Secret    string
     UnsafeGet bool
     DryRun    bool
-    temp      string
-    cleants   time.Time
+    CleanPolicies CleanPolicies
+    CleanInterval time.Duration
+    CleanDryRun   bool
+    TempTTL       time.Duration
+    JanitorInterval time.Duration
+    Durability    string
+    GroupCommit   time.Duration
+    ScrubRate     int64
+    ScrubInterval time.Duration
+    Compress      bool
+    CompressLevel int
+    ColdPath      string
+    MigrateAfter  time.Duration
+    MigrateInterval time.Duration
+    MinFree       int64
+    ResumeFree    int64
+    roots     []*root
+    hot       []*root
+    cold      []*root
+    promoting sync.Map
+    revalidating sync.Map
+    revalidateStats revalidateStats
+    jobs      jobs
+    tierStats tierStats
+    spaceStats spaceStats
+    cleaning  int32
+    janitorStats janitorStats
+    pending   chan *pending
+    grouped   chan struct{}
+    committing sync.RWMutex
+    scrubStats scrubStats
+    fetches   flights
+    fills     flights
+    puts      flights
+    memStats  memStats
+    warmStats warmStats
+    parents   parents
+    parentStats parentStats
+    forwards  chan *forward
+    httpClient *http.Client
+    credentials Credentials
+    fetchers  map[string]Fetcher
+    fetcherOnce sync.Once
+    listener  net.Listener
+    running   int32
+    quit      chan struct{}
+    closed    chan struct{}
+    loops     sync.WaitGroup
 }
 
 func (s *CacheServer) Listen() error {
     listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
     if err != nil {return err}
-    mcache.core.capacity = s.CacheCap
-    s.temp = path.Join(s.Path, "temp")
+    s.listener = listener
+    s.quit, s.closed = make(chan struct{}), make(chan struct{})
+    mcache.core.resize(s.CacheCap)
+    if roots, err := parseRoots(s.Path); err != nil {return err} else {s.hot = roots}
+    if s.ColdPath != "" {
+        roots, err := parseRoots(s.ColdPath)
+        if err != nil {return err}
+        for _, r := range roots { r.cold = true }
+        s.cold = roots
+    }
+    s.roots = append(append([]*root{}, s.hot...), s.cold...)
+    if s.FetchCredentials != "" {
+        v, err := LoadCredentials(s.FetchCredentials)
+        if err != nil {return err}
+        s.credentials = v
+    }
+    if err := s.registerFetchers(); err != nil {return err}
     {
         l, err := zap.NewDevelopment(zap.IncreaseLevel(zapcore.Level(s.LogLevel)))
         if err != nil { panic(err) }
         logger = l
     }
+    for _, r := range s.roots {
+        if err := r.open(); err != nil {return err}
+        s.recover(r)
+    }
+    s.publish()
+    s.spawn(s.monitor)
+    s.spawn(s.budget)
+    s.spawn(s.warm)
+    s.spawn(s.keep)
+    s.spawn(s.migrate)
+    s.spawn(s.janitor)
+    s.spawn(s.scrub)
+    {
+        workers, queue := s.JobWorkers, s.JobQueue
+        if workers <= 0 { workers = 4 }
+        if queue <= 0 { queue = 256 }
+        s.jobs.queue = make(chan *job, queue)
+        for i := 0; i < workers; i++ { go s.worker() }
+    }
+    if s.Parent != "" && s.ParentPut {
+        s.forwards = make(chan *forward, 1024)
+        for i := 0; i < 4; i++ { go s.forwarder() }
+    }
+    if s.Durability == DurabilityBatch {
+        s.pending = make(chan *pending, 1024)
+        s.grouped = make(chan struct{})
+        go s.group(s.pending, s.grouped)
+    }
     //go mcache.core.stat()
+    s.spawn(s.schedule)
+    atomic.StoreInt32(&s.running, 1) /* Close may read what is set up above from now on */
     for {
         c, err := listener.Accept()
-        if err != nil { continue }
+        if err != nil {
+            if s.stopping() {
+                <-s.closed
+                return nil
+            }
+            continue
+        }
         go s.Handle(c)
     }
 }
@@ -170,27 +280,189 @@ func (s *CacheServer) Send(c net.Conn, event chan *Context, version string) {
     }()
     conn := &Stream{Rwp: c}
 
-    buf := make([]byte, 64<<10)
+    features := uint32(0)
+    buf := getBuffer(64<<10)
+    defer putBuffer(buf)
     for ctx := range event {
         switch ctx.command {
+        case 'c':
+            p := 0
+            var report *CleanReport
+            if ctx.cleaned != nil { report = <-ctx.cleaned }
+            if ctx.denied || report == nil {
+                buf[p] = '-'
+                if !ctx.denied { buf[p] = 'b' } /* another pass is in progress */
+                p++
+                binary.BigEndian.PutUint32(buf[p:], 0)
+                binary.BigEndian.PutUint32(buf[p+4:], 0)
+                binary.BigEndian.PutUint64(buf[p+8:], 0)
+            } else {
+                buf[p] = '+'
+                p++
+                binary.BigEndian.PutUint32(buf[p:], uint32(report.Namespaces))
+                binary.BigEndian.PutUint32(buf[p+4:], uint32(report.Files))
+                binary.BigEndian.PutUint64(buf[p+8:], uint64(report.Size))
+            }
+            p += 16
+            if err := conn.Write(buf, p); err != nil { logger.Error("send clean err", zap.Error(err));return }
+            outgoing += int64(p)
+        case 'x':
+            if ctx.denied {
+                buf[0] = '-'
+                if err := conn.Write(buf, 1); err != nil { logger.Error("send export err", zap.Error(err));return }
+                outgoing++
+                continue
+            }
+            buf[0] = '+'
+            if err := conn.Write(buf, 1); err != nil { logger.Error("send export err", zap.Error(err));return }
+            w := &ChunkWriter{S: conn}
+            report, err := s.export(w, version, ctx.filter)
+            if err != nil { logger.Error("send export err", zap.Error(err));return }
+            if err := w.Close(); err != nil { logger.Error("send export err", zap.Error(err));return }
+            buf[0] = '+'
+            binary.BigEndian.PutUint32(buf[1:], uint32(report.Files))
+            binary.BigEndian.PutUint32(buf[5:], uint32(report.Skipped))
+            binary.BigEndian.PutUint64(buf[9:], uint64(report.Size))
+            if err := conn.Write(buf, 17); err != nil { logger.Error("send export err", zap.Error(err));return }
+            outgoing += 18 + report.Size
+        case 'i':
+            report := ctx.archive
+            buf[0] = '+'
+            if ctx.denied || report == nil {
+                buf[0] = '-'
+                report = &ArchiveReport{}
+            }
+            binary.BigEndian.PutUint32(buf[1:], uint32(report.Files))
+            binary.BigEndian.PutUint32(buf[5:], uint32(report.Skipped))
+            binary.BigEndian.PutUint32(buf[9:], uint32(report.Rejected))
+            binary.BigEndian.PutUint64(buf[13:], uint64(report.Size))
+            if err := conn.Write(buf, 21); err != nil { logger.Error("send import err", zap.Error(err));return }
+            outgoing += 21
+        case 'p':
+            p := 0
+            buf[p] = 'p'
+            p++
+            copy(buf[p:], ctx.id[:])
+            p += len(ctx.id)
+            binary.BigEndian.PutUint32(buf[p:], uint32(ctx.t))
+            p += 4
+            buf[p] = ctx.status
+            p++
+            if err := conn.Write(buf, p); err != nil { logger.Error("send put ack err", zap.Error(err));return }
+            outgoing += int64(p)
+        case 'u':
+            p := 0
+            buf[p] = 'u'
+            p++
+            copy(buf[p:], ctx.id[:])
+            p += len(ctx.id)
+            binary.BigEndian.PutUint32(buf[p:], uint32(ctx.t))
+            p += 4
+            binary.BigEndian.PutUint64(buf[p:], ctx.job.Id)
+            p += 8
+            if err := conn.Write(buf, p); err != nil { logger.Error("send uput job err", zap.Error(err));return }
+            outgoing += int64(p)
+        case 'j':
+            v := ctx.job
+            buf[0] = 'j'
+            binary.BigEndian.PutUint64(buf[1:], v.Id)
+            buf[9] = v.State
+            binary.BigEndian.PutUint64(buf[10:], uint64(v.Size))
+            binary.BigEndian.PutUint64(buf[18:], uint64(v.Received))
+            if err := conn.Write(buf, 26); err != nil { logger.Error("send job err", zap.Error(err));return }
+            if err := conn.WriteString(buf, v.Reason); err != nil { logger.Error("send job err", zap.Error(err));return }
+            outgoing += int64(28 + len(v.Reason))
+        case 'n':
+            features = ctx.features
+            buf[0] = 'n'
+            binary.BigEndian.PutUint32(buf[1:], features)
+            if err := conn.Write(buf, 5); err != nil { logger.Error("send negotiate err", zap.Error(err));return }
+            outgoing += 5
         case 'g':
             t := strconv.Itoa(ctx.t)
 
             exists := true
             var in *Stream
             size := int64(0)
-            filename := path.Join(s.Path, version, ctx.uuid[:2], ctx.uuid, t)
+            encoding := EncodingIdentity
+            r, m, ok := s.locate(version, ctx.uuid, ctx.t)
+            if !ok && ctx.flight == nil && s.PutWait > 0 && !s.DryRun {
+                if fr := s.puts.find(metaKey(version, ctx.uuid, ctx.t)); fr != nil {
+                    if ctx.flight = s.follow(fr); ctx.flight == nil { r, m, ok = s.locate(version, ctx.uuid, ctx.t) }
+                }
+            }
+            if !ok && ctx.flight == nil && s.Parent != "" && !s.DryRun { ctx.flight = s.upstream(version, ctx.uuid, ctx.t) }
+            filename := r.entry(&m)
             if s.DryRun {
                 in = &Stream{Rwp: &Air{}}
                 size = 2<<20
             } else {
-                if ctx.file != nil {
-                    in = &Stream{Rwp: ctx.file}
-                    size = ctx.file.size
+                if ctx.flight != nil {
+                    if n, err := ctx.flight.f.ready(); err == nil { size = n } else {
+                        ctx.flight.Close()
+                        exists = false
+                    }
+                    in = &Stream{Rwp: ctx.flight}
+                    if exists && ctx.flight.f.encoding != EncodingIdentity {
+                        encoding = ctx.flight.f.encoding
+                        if features & FeatureGzip == 0 {
+                            if gz, err := gzip.NewReader(ctx.flight); err != nil {
+                                ctx.flight.Close()
+                                logger.Error("get decode err", zap.String("file", filename), zap.Error(err))
+                                exists = false
+                            } else {
+                                in = &Stream{Rwp: &decoder{Reader: gz, c: ctx.flight}}
+                                size = ctx.flight.f.raw
+                                encoding = EncodingIdentity
+                            }
+                        }
+                    }
                 } else {
-                    file, err := Open(filename, ctx.uuid+t)
+                    key := metaKey(version, ctx.uuid, ctx.t)
+                    var fill, follow *flight
+                    file, err := Open(filename, key, func(size int64) bool {
+                        if !s.admit(ctx.t, size, m.Hits + 1, false) {return false}
+                        f, leader := s.fills.join(key)
+                        if leader { fill = f } else { follow = f }
+                        return leader
+                    })
+                    if follow != nil && err == nil { /* another connection is reading it into memory */
+                        file.Close()
+                        follow.wait()
+                        follow.release()
+                        file, err = Open(filename, key, func(int64) bool { return false })
+                    }
                     if err == nil { size = file.size } else { exists = false }
+                    if exists && ok && !file.c && !s.verify(r, &m, size) {
+                        file.Close()
+                        exists = false
+                    }
+                    if fill != nil {
+                        var err error
+                        if exists { err = file.load() } else { err = os.ErrNotExist }
+                        s.fills.land(fill, err)
+                        if exists && err != nil {
+                            logger.Error("get load err", zap.String("file", filename), zap.Error(err))
+                            file.Close()
+                            exists = false
+                        }
+                    }
                     in = &Stream{Rwp: file}
+                    if exists && ok && m.Encoding != "" {
+                        encoding = encodingOf(&m)
+                        if features & FeatureGzip == 0 {
+                            gz, err := gzip.NewReader(file)
+                            if err != nil {
+                                file.Close()
+                                logger.Error("get decode err", zap.String("file", filename), zap.Error(err))
+                                exists = false
+                            } else {
+                                in = &Stream{Rwp: &decoder{Reader: gz, c: file}}
+                                size = m.Size
+                                encoding = EncodingIdentity
+                            }
+                        }
+                    }
                 }
             }
 
@@ -214,12 +486,35 @@ func (s *CacheServer) Send(c net.Conn, event chan *Context, version string) {
                 binary.BigEndian.PutUint64(buf[p:], 0)
             }
             p += 8
+            if features & FeatureGzip != 0 {
+                buf[p] = encoding
+                p++
+            }
 
             if err := conn.Write(buf, p); err != nil { logger.Error("send get + err", zap.Error(err));return }
             outgoing += int64(p)
             if !exists {continue}
 
-            logger.Debug("get >>>", zap.String("uuid", ctx.uuid), zap.Int("type", ctx.t), zap.Int64("size", size))
+            logger.Debug("get >>>", zap.String("uuid", ctx.uuid), zap.Int("type", ctx.t), zap.Int64("size", size), zap.Uint8("encoding", encoding))
+            if !s.DryRun && ctx.flight == nil {
+                r.index.touch(version, ctx.uuid, ctx.t, size)
+                if r.cold {
+                    atomic.AddInt64(&s.tierStats.cold, 1)
+                    go s.promote(r, version, ctx.uuid, ctx.t) /* an open file keeps serving after cold copy is removed */
+                } else { atomic.AddInt64(&s.tierStats.hot, 1) }
+                if s.stale(&m) { go s.revalidate(r, m) }
+            }
+            if file, ok := in.Rwp.(*File); ok && s.ZeroCopy && file.f != nil && file.m == nil {
+                sent, err := sendFile(c, file.f, size)
+                file.Close()
+                outgoing += sent
+                if err != nil {
+                    logger.Error("get sendfile err", zap.Int64("sent", sent), zap.Int64("size", size), zap.Error(err))
+                    return
+                }
+                logger.Debug("get success", zap.Int64("sent", sent), zap.String("file", filename), zap.Bool("sendfile", true))
+                continue
+            }
             if file, ok := in.Rwp.(*File); ok && file.c {
                 m := file.m
                 if err := conn.Write(m.Bytes(), m.Len()); err != nil {
@@ -273,8 +568,10 @@ func (s *CacheServer) Handle(c net.Conn) {
     }()
 
     safe := true
+    features := uint32(0)
     var version string
-    buf := make([]byte, 16<<10)
+    buf := getBuffer(16<<10)
+    defer putBuffer(buf)
     if secret, err := conn.ReadString(buf); err != nil {return} else {
         if secret != s.Secret {
             if !s.UnsafeGet{return}
@@ -285,6 +582,9 @@ func (s *CacheServer) Handle(c net.Conn) {
     if ver, err := conn.ReadString(buf); err == nil {version = ver} else {
         logger.Error("read version err", zap.Error(err));return
     }
+    if !namespace(version) {
+        logger.Error("version refused", zap.String("addr", addr), zap.String("ver", version));return
+    }
     if err := conn.WriteString(buf, version); err != nil {
         logger.Error("echo version err", zap.String("ver", version), zap.Error(err));return
     }
@@ -302,8 +602,57 @@ func (s *CacheServer) Handle(c net.Conn) {
         cmd := buf[0]
         switch cmd {
         case 'c':
-            if conn.Read(buf, 2) == nil { go s.clean(version, binary.BigEndian.Uint16(buf)) } else {return}
-            incoming += 2
+            if err := conn.Read(buf, 1); err != nil {return}
+            incoming++
+            ctx := &Context{command: cmd, denied: !safe}
+            if safe {
+                ctx.cleaned = make(chan *CleanReport, 1)
+                go func(dry bool) { ctx.cleaned <- s.clean(dry) }(buf[0] & 1 == 1)
+            } else {
+                logger.Warn("clean denied", zap.String("addr", addr))
+            }
+            event <- ctx
+            continue
+        case 'x':
+            filter := &ArchiveFilter{Uuids: map[string]bool{}, Types: map[int]bool{}}
+            if err := conn.Read(buf, 2); err != nil {return}
+            for n := int(binary.BigEndian.Uint16(buf)); n > 0; n-- {
+                if err := conn.Read(buf, 32); err != nil {return}
+                filter.Uuids[hex.EncodeToString(buf[:32])] = true
+            }
+            if err := conn.Read(buf, 2); err != nil {return}
+            for n := int(binary.BigEndian.Uint16(buf)); n > 0; n-- {
+                if err := conn.Read(buf, 4); err != nil {return}
+                filter.Types[int(binary.BigEndian.Uint32(buf))] = true
+            }
+            incoming += int64(4 + 32 * len(filter.Uuids) + 4 * len(filter.Types))
+            if !safe { logger.Warn("export denied", zap.String("addr", addr)) }
+            event <- &Context{command: cmd, denied: !safe, filter: filter}
+            continue
+        case 'i':
+            r := &ChunkReader{S: conn}
+            ctx := &Context{command: cmd, denied: !safe}
+            if safe {
+                report, err := s.restore(r, version)
+                if err != nil { logger.Error("import err", zap.String("addr", addr), zap.Error(err)) } else { ctx.archive = report }
+            } else { logger.Warn("import denied", zap.String("addr", addr)) }
+            if err := discard(r); err != nil { logger.Error("import read err", zap.Error(err));return }
+            event <- ctx
+            continue
+        case 'j':
+            if err := conn.Read(buf, 8); err != nil {return}
+            incoming += 8
+            id := binary.BigEndian.Uint64(buf)
+            v := &JobStatus{Id: id, State: JobUnknown, Size: -1} /* reasons carry urls of other clients */
+            if safe { v = s.status(id) } else { logger.Warn("job status denied", zap.String("addr", addr)) }
+            event <- &Context{command: cmd, job: v}
+            continue
+        case 'n':
+            if err := conn.Read(buf, 4); err != nil {return}
+            incoming += 4
+            features = binary.BigEndian.Uint32(buf) & s.features()
+            logger.Debug("negotiate", zap.String("addr", addr), zap.Uint32("features", features))
+            event <- &Context{command: cmd, features: features}
             continue
         }
 
@@ -328,110 +677,203 @@ func (s *CacheServer) Handle(c net.Conn) {
             if err := conn.Read(b, 8); err != nil {logger.Error("put read id err", zap.Error(err));return}
             incoming += 8
             size := int64(binary.BigEndian.Uint64(b))
-            logger.Debug("put", zap.String("uuid", uuid), zap.Int("type", t), zap.Int64("size", size))
+            encoding, raw := EncodingIdentity, size
+            if features & FeatureGzip != 0 {
+                if err := conn.Read(b, 9); err != nil {logger.Error("put read encoding err", zap.Error(err));return}
+                incoming += 9
+                encoding, raw = b[0], int64(binary.BigEndian.Uint64(b[1:]))
+                if encoding > EncodingGzip {logger.Error("put encoding unsupported", zap.Uint8("encoding", encoding));return}
+            }
+            logger.Debug("put", zap.String("uuid", uuid), zap.Int("type", t), zap.Int64("size", size), zap.Uint8("encoding", encoding))
+            var pid [32]byte
+            copy(pid[:], id) /* buf is reused for body */
 
             var out *Stream
+            var h hash.Hash
+            var w io.Writer
+            var gz *gzip.Writer
+            var failure error
+            status := byte('+')
+            meta := &Meta{Version: version, Uuid: uuid, Type: t, Size: raw, Encoding: encodingName(encoding)}
             t := strconv.Itoa(t)
-            dir := path.Join(s.Path, version, uuid[:2], uuid)
-            filename := path.Join(dir, t)
-            if s.DryRun || !safe {out = &Stream{Rwp: Air{}}} else {
-                if err := s.mkdir(dir); err != nil {return}
+            r := s.place(uuid)
+            filename := ""
+            if r == nil {
+                status = s.rejection()
+                atomic.AddInt64(&s.spaceStats.rejected, 1)
+                logger.Warn("put rejected, no writable root", zap.String("uuid", uuid), zap.String("type", t), zap.String("status", string(status)))
+            } else { filename = r.filename(version, uuid, meta.Type) }
+            if !safe && !s.DryRun {
+                status = 'd' /* body is drained and dropped */
+                logger.Warn("put denied", zap.String("addr", addr), zap.String("uuid", uuid), zap.String("type", t))
+            }
+            if s.DryRun || !safe || r == nil {out = &Stream{Rwp: Air{}}} else {
                 name := buf[:32]
                 rand.Read(name)
-                if err := s.mktemp(); err != nil {return}
-                file, err := NewFile(path.Join(s.temp, hex.EncodeToString(name)), uuid+t, size)
-                if err != nil {logger.Error("put init err", zap.String("file", filename), zap.Error(err));return}
-                out = &Stream{Rwp: file}
+                var file *File
+                failure = r.mktemp()
+                if failure == nil { file, failure = NewFile(path.Join(r.temp, hex.EncodeToString(name)), meta.Key(), size, s.admit(meta.Type, size, 0, true)) }
+                if failure != nil {
+                    out = &Stream{Rwp: Air{}}
+                    logger.Error("put init err", zap.String("file", filename), zap.Error(failure))
+                } else {
+                    out = &Stream{Rwp: file}
+                    h = sha256.New()
+                    w = io.MultiWriter(file, h)
+                }
+            }
+            if w == nil { w = out.Rwp }
+            var pf *flight
+            stream := func() { /* content is stored as received, followers read temp file as it grows */
+                if in, err := os.Open(out.Name()); err == nil { pf.start(in, size, encoding, raw) }
+            }
+            if _, ok := out.Rwp.(*File); ok && s.PutWait > 0 {
+                leader := false
+                if pf, leader = s.puts.join(meta.Key()); !leader {
+                    pf.release()
+                    pf = nil
+                } else if !(s.Compress && encoding == EncodingIdentity) { stream() }
             }
 
             received := int64(0)
+            if file, ok := out.Rwp.(*File); ok && s.ZeroCopy && file.m == nil && !(s.Compress && encoding == EncodingIdentity) {
+                for received < size {
+                    num := size - received
+                    if num > 1<<20 { num = 1<<20 }
+                    n, err := receiveFile(file.f, c, num)
+                    if err == nil { err = hashBack(h, file.f, file.n, n, buf) }
+                    file.n += n
+                    received += n
+                    if err != nil {
+                        logger.Error("put receive err", zap.String("type", t), zap.Int64("received", received), zap.Int64("size", size), zap.Error(err))
+                        if isFull(err) { r.fail(err) }
+                        out.Close()
+                        os.Remove(out.Name())
+                        if pf != nil { s.puts.land(pf, err) }
+                        return
+                    }
+                    if pf != nil { pf.progress(n) }
+                }
+            }
             for received < size {
                 num := int64(len(buf))
                 if size - received < num { num = size - received }
-                if err := conn.Read(buf, int(num)); err != nil {out.Close();os.Remove(out.Name());return} else {
+                if err := conn.Read(buf, int(num)); err != nil {
+                    out.Close()
+                    os.Remove(out.Name())
+                    if pf != nil { s.puts.land(pf, err) }
+                    return
+                } else {
+                    if received == 0 && h != nil && s.Compress && encoding == EncodingIdentity {
+                        if compressible(buf[:num]) {
+                            gz, _ = gzip.NewWriterLevel(w, s.CompressLevel)
+                            w = gz
+                            meta.Encoding = encodingName(EncodingGzip)
+                        } else if pf != nil { stream() } /* compressed content is only served to followers once stored */
+                    }
                     received += num
-                    if err := out.Write(buf, int(num)); err != nil {
-                        out.Close()
-                        os.Remove(out.Name())
+                    if failure != nil {continue} /* drain body to keep connection usable */
+                    if _, err := w.Write(buf[:num]); err != nil {
+                        failure = err
                         logger.Error("put save err", zap.String("type", t), zap.Int64("received", received), zap.Int64("size", size), zap.Error(err))
-                        return
-                    }
+                    } else if pf != nil { pf.progress(num) }
+                }
+            }
+            if gz != nil && failure == nil {
+                if failure = gz.Close(); failure != nil {
+                    logger.Error("put compress err", zap.String("type", t), zap.Int64("received", received), zap.Error(failure))
                 }
             }
+            var held *bytes.Buffer /* memory copy of content, which is cached only once it is committed */
+            if file, ok := out.Rwp.(*File); ok { file.size, held, file.m = file.n, file.m, nil }
             out.Close()
-            if _, ok := out.Rwp.(*File); ok {
-                if err := os.Rename(out.Name(), filename); err != nil {
-                    logger.Error("put failure", zap.String("type", t), zap.Int64("received", received), zap.String("file", filename), zap.Error(err))
-                    return
+            invalid := false /* client declared wrong size, which is no fault of root */
+            if file, ok := out.Rwp.(*File); ok && failure == nil && encoding == EncodingGzip {
+                if n := gzipSize(file.Name()); uint32(n) != uint32(raw) { /* trailer keeps size modulo 4GB */
+                    failure, invalid = fmt.Errorf("gzip trailer size %d != %d", n, raw), true
+                    logger.Error("put size mismatch", zap.String("type", t), zap.Int64("raw", raw), zap.Int64("trailer", n))
                 }
             }
-            logger.Debug("put success", zap.String("type", t), zap.Int64("received", received), zap.String("file", filename))
+            if file, ok := out.Rwp.(*File); ok && failure == nil {
+                meta.Created = time.Now().UnixNano()
+                meta.Accessed = meta.Created
+                if h != nil { meta.Digest = hex.EncodeToString(h.Sum(nil)) }
+                if meta.Encoding != "" { meta.Stored = file.n }
+                filename = r.entry(meta)
+                commit := func() error { return s.commit(r, out.Name(), filename, meta) }
+                if pf != nil { failure = pf.settle(filename, commit) } else { failure = commit() } /* followers must not hold temp file while it is renamed */
+                if failure != nil {
+                    logger.Error("put failure", zap.String("type", t), zap.Int64("received", received), zap.String("file", filename), zap.Error(failure))
+                } else {
+                    if held != nil && int64(held.Len()) == file.n { mcache.core.put(meta.Key(), held); held = nil } else { mcache.core.drop(meta.Key()) } /* not admitted, forget previous content */
+                    if s.forwards != nil { s.relay(meta) }
+                }
+            }
+            if held != nil {
+                held.Reset()
+                putBuffer(held.Bytes())
+            }
+            if pf != nil { s.puts.land(pf, failure) }
+            if failure != nil {
+                if name := out.Name(); name != "" { os.Remove(name) }
+                if !invalid { r.fail(failure) }
+                status = '-'
+                if isFull(failure) {
+                    status = 'r'
+                    atomic.AddInt64(&s.spaceStats.rejected, 1)
+                }
+            } else if status == '+' {
+                logger.Debug("put success", zap.String("type", t), zap.Int64("received", received), zap.String("file", filename), zap.String("encoding", meta.Encoding))
+            }
             incoming += received
+            if features & FeaturePutAck != 0 {
+                ctx := &Context{command: cmd, status: status}
+                ctx.uuid = uuid
+                ctx.t = meta.Type
+                ctx.id = pid
+                event <- ctx
+            }
         case 'u':
             if err := conn.Read(b, 1); err != nil {return}
             cmd := b[0]
 
             u := ""
             if s, err := conn.ReadString(b); err == nil {u=s} else {logger.Error("url", zap.Error(err));return}
-            dir := path.Join(s.Path, version, uuid[:2], uuid)
-            filename := path.Join(dir, strconv.Itoa(t))
             switch cmd {
             case 'g':
+                lr, m, exists := s.locate(version, uuid, t)
+                if exists && s.expired(&m) {exists = false} else if exists && s.stale(&m) { go s.revalidate(lr, m) }
+                r := s.place(uuid)
+                if r == nil {
+                    logger.Warn("url fill skipped, no writable root", zap.String("url", u))
+                    exists = true
+                } else if !safe && !exists { /* fills apply server credentials, a miss is all unsafe connections get */
+                    logger.Warn("url fill denied", zap.String("addr", addr), zap.String("url", u))
+                    exists = true
+                }
                 ctx := &Context{}
                 ctx.command = cmd
                 ctx.uuid = uuid
                 ctx.t = t
                 copy(ctx.id[:], id)
-                logger.Debug("uget", zap.String("url", u))
-                if _, err := os.Stat(filename); err != nil && os.IsNotExist(err) {
-                    if rsp, err := http.Get(u); err == nil {
-                        success := false
-                        if rsp.ContentLength > 0 {
-                            if err := s.mktemp(); err == nil {
-                                rand.Read(buf[:32])
-                                if f, err := os.OpenFile(path.Join(s.temp, hex.EncodeToString(buf[:32])), os.O_CREATE | os.O_WRONLY, 0700); err == nil {
-                                    if err := s.mkdir(dir); err == nil {
-                                        success = true
-                                        ctx.file = &WebFile{body: rsp.Body, size: rsp.ContentLength, name: filename, file: f}
-                                        logger.Debug("uget pipe", zap.Int64("size", rsp.ContentLength), zap.String("url", u))
-                                    } else {
-                                        logger.Error("uget pipe", zap.Int64("size", rsp.ContentLength), zap.String("url", u), zap.Error(err))
-                                    }
-                                }
-                            }
-                        }
-                        if !success { rsp.Body.Close() }
-                    }
+                if !exists {
+                    f, leader := s.fetches.join(metaKey(version, uuid, t))
+                    ctx.flight = f.reader()
+                    if leader { go s.launch(f, u, r, &Meta{Version: version, Uuid: uuid, Type: t}) } else { f.release() }
                 }
+                logger.Debug("uget", zap.String("url", u))
                 event <- ctx
             case 'p':
-                logger.Debug("uput", zap.String("url", u))
-                if rsp, err := http.Get(u); err == nil {
-                    go func() {
-                        defer rsp.Body.Close()
-                        if rsp.ContentLength > 0 {
-                            if err := s.mktemp(); err == nil {
-                                name := make([]byte, 32)
-                                rand.Read(name)
-                                if f, err := os.OpenFile(path.Join(s.temp, hex.EncodeToString(name)), os.O_CREATE | os.O_WRONLY, 0700); err == nil {
-                                    if n, err := io.Copy(f, rsp.Body); err != nil {
-                                        logger.Error("uput", zap.Int64("received", n), zap.Int64("expect", rsp.ContentLength), zap.String("url", u), zap.Error(err))
-                                        f.Close()
-                                        return
-                                    }
-                                    if s.mkdir(dir) == nil {
-                                        f.Close()
-                                        if err := os.Rename(f.Name(), filename); err == nil {
-                                            logger.Debug("uput success", zap.Int64("size", rsp.ContentLength), zap.String("url", u), zap.String("name", filename))
-                                        } else {
-                                            logger.Error("uput failure", zap.Int64("size", rsp.ContentLength), zap.String("url", u), zap.Error(err))
-                                        }
-                                    }
-                                }
-                            }
-                        }
-                    }()
-                } else { logger.Error("uput", zap.String("url", u), zap.Error(err)) }
+                j := &job{} /* id 0 is never assigned, so status of a denied uput is unknown */
+                if safe { j = s.submit(u, version, uuid, t) } else { logger.Warn("uput denied", zap.String("addr", addr), zap.String("url", u)) }
+                logger.Debug("uput", zap.String("url", u), zap.Uint64("job", j.id))
+                if features & FeatureJobs != 0 {
+                    ctx := &Context{command: 'u', job: &JobStatus{Id: j.id}}
+                    ctx.uuid = uuid
+                    ctx.t = t
+                    copy(ctx.id[:], id)
+                    event <- ctx
+                }
             }
         default:
             logger.Error("unsupported command", zap.String("cmd", string(cmd)))
@@ -440,32 +882,56 @@ func (s *CacheServer) Handle(c net.Conn) {
     }
 }
 
-func (s *CacheServer) mktemp() error {
-    if _, err := os.Stat(s.temp); err != nil && os.IsNotExist(err) { return os.MkdirAll(s.temp, 0700) }
+// Close stops accepting connections and background passes, commits queued entries,
+// persists hot keys of memory cache and flushes indexes before process exits, Listen returns once it is done
+func (s *CacheServer) Close() error {
+    if !atomic.CompareAndSwapInt32(&s.running, 1, 0) {return nil} /* not listening yet or closed already */
+    defer close(s.closed)
+    close(s.quit)
+    s.listener.Close()
+    s.loops.Wait()
+    s.drain()
+    if err := s.persist(); err != nil { logger.Error("persist hot keys", zap.Error(err)) }
+    for _, r := range s.roots {
+        if r.index == nil {continue}
+        if err := r.index.close(); err != nil { logger.Error("close index", zap.String("root", r.path), zap.Error(err)) }
+    }
     return nil
 }
 
-func (s *CacheServer) mkdir(dir string) error {
-    if _, err := os.Stat(dir); err != nil && os.IsNotExist(err) { return os.MkdirAll(dir, 0700) }
-    return nil
+// spawn runs background pass fn in a goroutine that Close waits for
+func (s *CacheServer) spawn(fn func()) {
+    s.loops.Add(1)
+    go func() {
+        defer s.loops.Done()
+        fn()
+    }()
 }
 
-func (s *CacheServer) clean(version string, days uint16) {
-    ts := time.Now()
-    if ts.Sub(s.cleants) < time.Hour {return}
-    s.cleants = ts
-
-    dir := path.Join(s.Path, version)
-    logger.Info("clean", zap.String("dir", dir), zap.Uint16("days", days))
-    filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-        if err != nil {return err}
-        if t := times.Get(info); !info.IsDir() {
-            if !t.AccessTime().IsZero() && ts.Sub(t.AccessTime()) > time.Duration(days) * 24 * time.Hour {
-                if err := os.Remove(path); err == nil {
-                    logger.Info("clean", zap.String("name", path), zap.Int64("size", info.Size()))
-                }
-            }
+// every runs fn each interval until server is closing
+func (s *CacheServer) every(interval time.Duration, fn func()) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.quit: return
+        case <-ticker.C: fn()
         }
-        return nil
-    })
-}
\ No newline at end of file
+    }
+}
+
+// stopping reports whether Close was called, long passes check it between entries
+func (s *CacheServer) stopping() bool {
+    select {
+    case <-s.quit: return true
+    default: return false
+    }
+}
+
+func (s *CacheServer) features() uint32 {
+    return supported
+}
+
+func (s *CacheServer) mkdir(dir string) error {
+    return mkdir(dir)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// Source is content of a url fill, Size is negative when unknown
+type Source struct {
+    Body     io.ReadCloser
+    Size     int64
+    ETag     string
+    Modified string
+}
+
+// ErrNotModified is returned by fetchers when content still matches validators of entry being revalidated
+var ErrNotModified = errors.New("not modified")
+
+// Fetcher opens content of urls of a scheme for url fills, m carries validators of current entry when it is revalidated
+type Fetcher interface {
+    Fetch(u *url.URL, m *Meta) (*Source, error)
+}
+
+// Register makes url fills of scheme use fetcher f, it must be called before Listen and overrides builtin fetchers
+func (s *CacheServer) Register(scheme string, f Fetcher) {
+    if s.fetchers == nil { s.fetchers = map[string]Fetcher{} }
+    s.fetchers[scheme] = f
+}
+
+// registerFetchers adds builtin fetchers of schemes not registered yet, file urls are only served under FetchFiles
+func (s *CacheServer) registerFetchers() error {
+    builtin := map[string]Fetcher{"http": &httpFetcher{s}, "https": &httpFetcher{s}, "gocache": &gocacheFetcher{s}, "s3": &s3Fetcher{s}}
+    if s.FetchFiles != "" {
+        f := &fileFetcher{}
+        for _, dir := range strings.Split(s.FetchFiles, ",") {
+            dir, err := filepath.EvalSymlinks(strings.TrimSpace(dir))
+            if err != nil {return err}
+            if dir, err = filepath.Abs(dir); err != nil {return err}
+            f.roots = append(f.roots, dir)
+        }
+        builtin["file"] = f
+    }
+    for scheme, f := range builtin {
+        if _, ok := s.fetchers[scheme]; !ok { s.Register(scheme, f) }
+    }
+    return nil
+}
+
+// maxUrl bounds urls of fills, which are kept in index records
+const maxUrl = 8 << 10
+
+// open fetches u with fetcher of its scheme once FetchAllow allows it, content larger than FetchMax is refused
+func (s *CacheServer) open(u string, m *Meta) (*Source, error) {
+    if len(u) > maxUrl {return nil, fmt.Errorf("fetch url longer than %d", maxUrl)}
+    target, err := url.Parse(u)
+    if err != nil {return nil, err}
+    f, ok := s.fetchers[target.Scheme]
+    if !ok {return nil, fmt.Errorf("fetch scheme unsupported: %s", u)}
+    if !s.FetchAllow.allow(target) {return nil, fmt.Errorf("fetch not allowed: %s", u)}
+    src, err := f.Fetch(target, m)
+    if err != nil {return nil, err}
+    if s.FetchMax > 0 && src.Size > s.FetchMax {
+        src.Body.Close()
+        return nil, fmt.Errorf("fetch %s size %d exceeds %d", u, src.Size, s.FetchMax)
+    }
+    return src, nil
+}
+
+// conditional returns request header revalidating m, which is nil for unconditional requests
+func conditional(m *Meta) http.Header {
+    header := http.Header{}
+    if m == nil {return header}
+    if m.ETag != "" { header.Set("If-None-Match", m.ETag) }
+    if m.Modified != "" { header.Set("If-Modified-Since", m.Modified) }
+    return header
+}
+
+// httpSource converts response of download, a 304 tells entry is not modified
+func httpSource(rsp *http.Response) (*Source, error) {
+    if rsp.StatusCode == http.StatusNotModified {
+        rsp.Body.Close()
+        return nil, ErrNotModified
+    }
+    return &Source{Body: rsp.Body, Size: rsp.ContentLength, ETag: rsp.Header.Get("ETag"), Modified: rsp.Header.Get("Last-Modified")}, nil
+}
+
+type httpFetcher struct {
+    s *CacheServer
+}
+
+func (f *httpFetcher) Fetch(u *url.URL, m *Meta) (*Source, error) {
+    rsp, err := f.s.download(u.String(), conditional(m), f.s.credentials.match(u))
+    if err != nil {return nil, err}
+    return httpSource(rsp)
+}
+
+// fileFetcher fills entries from files under roots, such as shared mounts, addressed as file:///path
+type fileFetcher struct {
+    roots []string
+}
+
+func (f *fileFetcher) Fetch(u *url.URL, m *Meta) (*Source, error) {
+    if u.Host != "" && u.Host != "localhost" {return nil, fmt.Errorf("file host unsupported: %s", u.Host)}
+    name, err := filepath.EvalSymlinks(filepath.FromSlash(u.Path)) /* a link must not lead out of roots */
+    if err != nil {return nil, err}
+    if !f.contains(name) {return nil, fmt.Errorf("file outside fetch roots: %s", u.Path)}
+    file, err := os.Open(name)
+    if err != nil {return nil, err}
+    info, err := file.Stat()
+    if err == nil && info.IsDir() { err = fmt.Errorf("file is a directory: %s", u.Path) }
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    etag := fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+    if m != nil && m.ETag == etag {
+        file.Close()
+        return nil, ErrNotModified
+    }
+    return &Source{Body: file, Size: info.Size(), ETag: etag, Modified: info.ModTime().UTC().Format(http.TimeFormat)}, nil
+}
+
+func (f *fileFetcher) contains(name string) bool {
+    for _, root := range f.roots {
+        rel, err := filepath.Rel(root, name)
+        if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {return true}
+    }
+    return false
+}
+
+// gocacheFetcher fills entries from another gocache server addressed as gocache://host[:port]/version/uuid/type,
+// it connects with bearer token of credential matching the url as secret, or ParentSecret when it is the parent server and no secret otherwise
+type gocacheFetcher struct {
+    s *CacheServer
+}
+
+func (f *gocacheFetcher) Fetch(u *url.URL, m *Meta) (*Source, error) {
+    parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+    if len(parts) != 3 {return nil, fmt.Errorf("gocache url malformed: %s", u)}
+    version, uuid := parts[0], strings.ToLower(parts[1])
+    if id, err := hex.DecodeString(uuid); err != nil || len(id) != 32 {return nil, fmt.Errorf("gocache url uuid malformed: %s", u)}
+    t, err := strconv.Atoi(parts[2])
+    if err != nil {return nil, fmt.Errorf("gocache url type malformed: %s", u)}
+    addr := u.Host
+    if u.Port() == "" { addr = net.JoinHostPort(u.Hostname(), "9966") }
+    secret := ""
+    if strings.EqualFold(addr, f.s.Parent) { secret = f.s.ParentSecret } /* never hand it to servers named by clients */
+    if c := f.s.credentials.match(u); c != nil && c.Bearer != "" { secret = c.Bearer }
+    body, err := f.s.remote(addr, secret, version, uuid, t)
+    if err != nil {return nil, err}
+    return &Source{Body: body, Size: body.left}, nil
+}
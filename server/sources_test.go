@@ -0,0 +1,134 @@
+package server
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func read(t *testing.T, s *CacheServer, u string, m *Meta) ([]byte, *Source, error) {
+    src, err := s.open(u, m)
+    if err != nil {return nil, nil, err}
+    defer src.Body.Close()
+    b, err := ioutil.ReadAll(src.Body)
+    if err != nil { t.Fatalf("read %s: %v", u, err) }
+    return b, src, nil
+}
+
+func TestFileFetcher(t *testing.T) {
+    base, err := filepath.EvalSymlinks(t.TempDir())
+    if err != nil { t.Fatal(err) }
+    root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+    for _, dir := range []string{root, outside} {
+        if err := os.Mkdir(dir, 0700); err != nil { t.Fatal(err) }
+    }
+    content := []byte("shared mount content")
+    if err := ioutil.WriteFile(filepath.Join(root, "a.bin"), content, 0600); err != nil { t.Fatal(err) }
+    if err := ioutil.WriteFile(filepath.Join(outside, "secret.bin"), []byte("secret"), 0600); err != nil { t.Fatal(err) }
+    if err := os.Symlink(filepath.Join(outside, "secret.bin"), filepath.Join(root, "link.bin")); err != nil { t.Fatal(err) }
+
+    s := &CacheServer{FetchFiles: root}
+    if err := s.registerFetchers(); err != nil { t.Fatal(err) }
+    u := "file://" + filepath.ToSlash(root)
+    b, src, err := read(t, s, u + "/a.bin", nil)
+    if err != nil || !bytes.Equal(b, content) || src.Size != int64(len(content)) || src.ETag == "" {
+        t.Fatalf("file fetch: %q %v %v", b, src, err)
+    }
+    if _, err := s.open(u + "/a.bin", &Meta{ETag: src.ETag}); err != ErrNotModified {
+        t.Fatalf("file revalidate: %v", err)
+    }
+    if _, _, err := read(t, s, u + "/link.bin", nil); err == nil || !strings.Contains(err.Error(), "outside fetch roots") {
+        t.Fatalf("symlink escape: %v", err)
+    }
+    if _, _, err := read(t, s, u + "/../outside/secret.bin", nil); err == nil || !strings.Contains(err.Error(), "outside fetch roots") {
+        t.Fatalf("dot dot escape: %v", err)
+    }
+    if _, _, err := read(t, s, u, nil); err == nil {
+        t.Fatalf("directory fetched")
+    }
+
+    none := &CacheServer{}
+    none.registerFetchers()
+    if _, err := none.open(u + "/a.bin", nil); err == nil || !strings.Contains(err.Error(), "unsupported") {
+        t.Fatalf("file fetched without fetch roots: %v", err)
+    }
+}
+
+// upstream is a gocache server shared by tests, which is started once per process since Listen replaces package logger
+var upstream struct {
+    once sync.Once
+    s    *CacheServer
+    addr string
+}
+
+// serve starts upstream serving content as entry v1/uuid/1 and returns its address on loopback
+func serve(t *testing.T, uuid string, content []byte) string {
+    upstream.once.Do(func() {
+        dir, err := ioutil.TempDir("", "upstream")
+        if err != nil { t.Fatal(err) }
+        name := path.Join(dir, "v1", uuid[:2], uuid, "1")
+        if err := os.MkdirAll(path.Dir(name), 0700); err != nil { t.Fatal(err) }
+        if err := ioutil.WriteFile(name, content, 0600); err != nil { t.Fatal(err) }
+        s := &CacheServer{Path: dir, Secret: "upstream", LogLevel: 5 /* fatal only */}
+        failed := make(chan error, 1)
+        go func() { failed <- s.Listen() }()
+        for atomic.LoadInt32(&s.running) == 0 {
+            select {
+            case err := <-failed: t.Fatalf("listen: %v", err)
+            case <-time.After(10 * time.Millisecond):
+            }
+        }
+        upstream.s, upstream.addr = s, fmt.Sprintf("127.0.0.1:%d", s.listener.Addr().(*net.TCPAddr).Port)
+    })
+    if upstream.addr == "" { t.Fatal("upstream not listening") }
+    return upstream.addr
+}
+
+func TestGocacheFetcher(t *testing.T) {
+    uuid := strings.Repeat("ab", 32)
+    content := []byte("entry of upstream gocache server")
+    addr := serve(t, uuid, content)
+    u := fmt.Sprintf("gocache://%s/v1/%s/1", addr, uuid)
+
+    s := &CacheServer{Parent: addr, ParentSecret: "upstream"}
+    s.registerFetchers()
+    if _, err := s.open(u, nil); err == nil || !strings.Contains(err.Error(), "not allowed") {
+        t.Fatalf("gocache fetched without a rule: %v", err)
+    }
+    if err := s.FetchAllow.Set("https://*"); err != nil { t.Fatal(err) }
+    if _, err := s.open(u, nil); err == nil || !strings.Contains(err.Error(), "not allowed") {
+        t.Fatalf("gocache fetched by http rule: %v", err)
+    }
+    if err := s.FetchAllow.Set("gocache://127.0.0.1"); err != nil { t.Fatal(err) }
+    b, src, err := read(t, s, u, nil)
+    if err != nil || !bytes.Equal(b, content) || src.Size != int64(len(content)) {
+        t.Fatalf("gocache fetch: %q %v", b, err)
+    }
+    if _, _, err := read(t, s, fmt.Sprintf("gocache://%s/v1/%s/2", addr, uuid), nil); err != os.ErrNotExist {
+        t.Fatalf("gocache miss: %v", err)
+    }
+    if _, err := s.open(fmt.Sprintf("gocache://%s/v1/abc/1", addr), nil); err == nil {
+        t.Fatalf("malformed uuid fetched")
+    }
+
+    other := &CacheServer{Parent: "127.0.0.1:1", ParentSecret: "upstream", FetchAllow: s.FetchAllow}
+    other.registerFetchers()
+    if _, err := other.open(u, nil); err == nil {
+        t.Fatalf("parent secret sent to a server other than parent")
+    }
+    c := &Credential{Match: "gocache://127.0.0.1", Bearer: "upstream"}
+    if err := c.init(); err != nil { t.Fatal(err) }
+    other.credentials = Credentials{c}
+    if b, _, err := read(t, other, u, nil); err != nil || !bytes.Equal(b, content) {
+        t.Fatalf("gocache fetch with bearer: %q %v", b, err)
+    }
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+    "go.uber.org/zap"
+    "os"
+    "sort"
+    "sync/atomic"
+)
+
+type spaceStats struct {
+    rejected int64
+    evicted  int64
+    size     int64
+}
+
+// watch switches root read-only once free space drops below MinFree, evicts least recently accessed
+// entries until free space reaches ResumeFree, and makes root writable again after that
+func (s *CacheServer) watch(r *root) {
+    free, total, err := diskFree(r.path)
+    if err != nil {return}
+    atomic.StoreInt64(&r.free, free)
+    atomic.StoreInt64(&r.total, total)
+    if s.MinFree <= 0 {return}
+    resume := s.ResumeFree
+    if resume <= s.MinFree { resume = 2 * s.MinFree }
+    if free < s.MinFree && atomic.CompareAndSwapInt32(&r.full, 0, 1) {
+        logger.Warn("root read-only", zap.String("root", r.path), zap.Int64("free", free), zap.Int64("min", s.MinFree))
+    }
+    if atomic.LoadInt32(&r.full) == 0 {return}
+    if free < resume {
+        s.evict(r, resume - free)
+        if free, _, err = diskFree(r.path); err != nil {return}
+        atomic.StoreInt64(&r.free, free)
+    }
+    if free >= resume && atomic.CompareAndSwapInt32(&r.full, 1, 0) {
+        logger.Info("root writable", zap.String("root", r.path), zap.Int64("free", free), zap.Int64("resume", resume))
+    }
+}
+
+// evict removes least recently accessed entries of root until at least size bytes are reclaimed
+func (s *CacheServer) evict(r *root, size int64) {
+    if !atomic.CompareAndSwapInt32(&r.evicting, 0, 1) {return}
+    defer atomic.StoreInt32(&r.evicting, 0)
+    entries := r.index.list("")
+    sort.Slice(entries, func(i, j int) bool { return entries[i].Accessed < entries[j].Accessed })
+    evicted, reclaimed := 0, int64(0)
+    for _, m := range entries {
+        if reclaimed >= size {break}
+        name := r.entry(&m)
+        if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+            logger.Error("evict", zap.String("file", name), zap.Error(err))
+            continue
+        }
+        r.index.remove(&m)
+        mcache.core.drop(m.Key())
+        evicted++
+        reclaimed += m.Disk()
+    }
+    atomic.AddInt64(&s.spaceStats.evicted, int64(evicted))
+    atomic.AddInt64(&s.spaceStats.size, reclaimed)
+    logger.Warn("emergency evict", zap.String("root", r.path), zap.Int("files", evicted), zap.Int64("size", reclaimed), zap.Int64("need", size))
+}
+
+// rejection is the put status when no root accepts writes
+func (s *CacheServer) rejection() byte {
+    for _, r := range s.hot {
+        if atomic.LoadInt32(&r.full) == 1 {return 'r'}
+    }
+    return '-'
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+    "encoding/json"
+    "expvar"
+    "net/http"
+    "sort"
+    "sync"
+    "sync/atomic"
+)
+
+var published sync.Once
+
+// publish exposes stats under /debug/vars and entry listing under /gocache/list of the default http mux,
+// only the first server listening in process is published since both register names globally
+func (s *CacheServer) publish() {
+    published.Do(func() {
+        expvar.Publish("gocache", expvar.Func(s.stats))
+        http.HandleFunc("/gocache/list", s.list)
+    })
+}
+
+func (s *CacheServer) stats() interface{} {
+    return map[string]interface{}{
+        "namespaces": s.namespaces(),
+        "mcache": mcache.core.stats(),
+        "pool": pool.stats(),
+        "flights": map[string]interface{}{"fetches": s.fetches.stats(), "fills": s.fills.stats(), "puts": s.puts.stats()},
+        "parent": map[string]int64{
+            "hits": atomic.LoadInt64(&s.parentStats.hits),
+            "misses": atomic.LoadInt64(&s.parentStats.misses),
+            "failures": atomic.LoadInt64(&s.parentStats.failures),
+            "forwarded": atomic.LoadInt64(&s.parentStats.forwarded),
+            "rejected": atomic.LoadInt64(&s.parentStats.rejected),
+        },
+        "revalidate": map[string]int64{
+            "checks": atomic.LoadInt64(&s.revalidateStats.checks),
+            "unchanged": atomic.LoadInt64(&s.revalidateStats.unchanged),
+            "replaced": atomic.LoadInt64(&s.revalidateStats.replaced),
+            "failures": atomic.LoadInt64(&s.revalidateStats.failures),
+        },
+        "jobs": s.jobStats(),
+        "warm": map[string]int64{
+            "files": atomic.LoadInt64(&s.warmStats.files),
+            "size": atomic.LoadInt64(&s.warmStats.size),
+            "done": atomic.LoadInt64(&s.warmStats.done),
+        },
+        "memory": map[string]interface{}{
+            "limit": atomic.LoadInt64(&s.memStats.limit),
+            "heap": atomic.LoadInt64(&s.memStats.heap),
+            "budget": atomic.LoadInt64(&mcache.core.capacity),
+            "pressure": float64(atomic.LoadInt64(&s.memStats.pressure)) / 1000,
+            "shrinks": atomic.LoadInt64(&s.memStats.shrinks),
+        },
+        "roots": s.rootStats(),
+        "space": map[string]int64{
+            "rejected": atomic.LoadInt64(&s.spaceStats.rejected),
+            "evicted": atomic.LoadInt64(&s.spaceStats.evicted),
+            "size": atomic.LoadInt64(&s.spaceStats.size),
+        },
+        "tiers": map[string]int64{
+            "hot": atomic.LoadInt64(&s.tierStats.hot),
+            "cold": atomic.LoadInt64(&s.tierStats.cold),
+            "promoted": atomic.LoadInt64(&s.tierStats.promoted),
+            "migrated": atomic.LoadInt64(&s.tierStats.migrated),
+        },
+        "janitor": map[string]int64{
+            "passes": atomic.LoadInt64(&s.janitorStats.passes),
+            "files": atomic.LoadInt64(&s.janitorStats.files),
+            "size": atomic.LoadInt64(&s.janitorStats.size),
+            "dirs": atomic.LoadInt64(&s.janitorStats.dirs),
+        },
+        "scrub": map[string]int64{
+            "passes": atomic.LoadInt64(&s.scrubStats.passes),
+            "files": atomic.LoadInt64(&s.scrubStats.files),
+            "size": atomic.LoadInt64(&s.scrubStats.size),
+            "corrupt": atomic.LoadInt64(&s.scrubStats.corrupt),
+            "last": atomic.LoadInt64(&s.scrubStats.last),
+        },
+    }
+}
+
+// list writes metas of namespace given by query parameter version, the most recently accessed first
+func (s *CacheServer) list(w http.ResponseWriter, r *http.Request) {
+    var entries []Meta
+    for _, root := range s.roots { entries = append(entries, root.index.list(r.URL.Query().Get("version"))...) }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].Accessed > entries[j].Accessed })
+    w.Header().Set("Content-Type", "application/json")
+    enc := json.NewEncoder(w)
+    for i := range entries {
+        if err := enc.Encode(&entries[i]); err != nil {return}
+    }
+}
+
+// namespaces merges namespace stats of all roots
+func (s *CacheServer) namespaces() map[string]*Namespace {
+    v := map[string]*Namespace{}
+    for _, r := range s.roots {
+        for name, n := range r.index.namespaces() {
+            m, ok := v[name]
+            if !ok {
+                v[name] = n
+                continue
+            }
+            m.Entries += n.Entries
+            m.Size += n.Size
+            m.Hits += n.Hits
+            if n.Accessed > m.Accessed { m.Accessed = n.Accessed }
+            if n.Created < m.Created { m.Created = n.Created }
+        }
+    }
+    return v
+}
+
+func (s *CacheServer) rootStats() []map[string]interface{} {
+    var v []map[string]interface{}
+    for _, r := range s.roots {
+        entries, size := 0, int64(0)
+        for _, n := range r.index.namespaces() {
+            entries += n.Entries
+            size += n.Size
+        }
+        v = append(v, map[string]interface{}{
+            "path": r.path,
+            "weight": r.weight,
+            "entries": entries,
+            "size": size,
+            "degraded": r.readonly(),
+            "cold": r.cold,
+            "full": atomic.LoadInt32(&r.full) == 1,
+            "free": atomic.LoadInt64(&r.free),
+            "total": atomic.LoadInt64(&r.total),
+        })
+    }
+    return v
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+    "fmt"
+    "go.uber.org/zap"
+    "hash/fnv"
+    "io/ioutil"
+    "math"
+    "os"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// root is one storage directory, entries are spread across roots by weighted rendezvous hashing of uuid
+type root struct {
+    path        string
+    weight      float64
+    temp        string
+    quarantined string
+    index       *index
+    degraded    int32
+    cold        bool
+    full        int32
+    evicting    int32
+    free        int64
+    total       int64
+}
+
+// parseRoots parses comma separated storage directories, each optionally suffixed with :weight
+func parseRoots(v string) ([]*root, error) {
+    var roots []*root
+    for _, item := range strings.Split(v, ",") {
+        item = strings.TrimSpace(item)
+        if item == "" {continue}
+        r := &root{path: item, weight: 1}
+        if i := strings.LastIndex(item, ":"); i > 0 {
+            if w, err := strconv.ParseFloat(item[i+1:], 64); err == nil {
+                if w <= 0 {return nil, fmt.Errorf("root weight must be positive: %s", item)}
+                r.path, r.weight = item[:i], w
+            }
+        }
+        r.temp = path.Join(r.path, "temp")
+        r.quarantined = path.Join(r.path, "quarantine")
+        roots = append(roots, r)
+    }
+    if len(roots) == 0 {return nil, fmt.Errorf("no storage path")}
+    return roots, nil
+}
+
+func (r *root) open() error {
+    if err := mkdir(r.path); err != nil {return err}
+    x, err := openIndex(path.Join(r.path, "index.log"), r.path, r.temp, r.quarantined)
+    if err != nil {return err}
+    r.index = x
+    return nil
+}
+
+// adopt indexes files whose records were lost, e.g. still buffered when previous process was killed
+func (r *root) adopt() int {
+    return r.index.scan(r.path, []string{r.temp, r.quarantined})
+}
+
+func (r *root) filename(version string, uuid string, t int) string {
+    return path.Join(r.path, version, uuid[:2], uuid, strconv.Itoa(t))
+}
+
+// entry returns name of stored file, encoded entries carry a suffix
+func (r *root) entry(m *Meta) string {
+    name := r.filename(m.Version, m.Uuid, m.Type)
+    if encodingOf(m) == EncodingGzip { name += gzipSuffix }
+    return name
+}
+
+// reserved reports whether dir under root is used by server itself rather than a namespace
+func (r *root) reserved(dir string) bool {
+    return dir == r.temp || dir == r.quarantined
+}
+
+// namespace reports whether version names a directory right under storage roots, which handshakes of other versions are refused
+func namespace(version string) bool {
+    switch version {
+    case "", ".", "..", "temp", "quarantine": return false
+    }
+    return !strings.ContainsAny(version, "/\\:\x00")
+}
+
+func (r *root) mktemp() error {
+    return mkdir(r.temp)
+}
+
+func (r *root) readonly() bool { return atomic.LoadInt32(&r.degraded) == 1 || atomic.LoadInt32(&r.full) == 1 }
+
+// fail switches root into read-only degraded mode until a probe succeeds again, running out of space only makes it full
+func (r *root) fail(err error) {
+    if isFull(err) {
+        if atomic.CompareAndSwapInt32(&r.full, 0, 1) { logger.Error("root full", zap.String("root", r.path), zap.Error(err)) }
+        return
+    }
+    if atomic.CompareAndSwapInt32(&r.degraded, 0, 1) {
+        logger.Error("root degraded", zap.String("root", r.path), zap.Error(err))
+    }
+}
+
+// probe writes, syncs and removes a small file to check that root is still writable
+func (r *root) probe() error {
+    if err := r.mktemp(); err != nil {return err}
+    name := path.Join(r.temp, "probe")
+    if err := ioutil.WriteFile(name, []byte(r.path), 0700); err != nil {return err}
+    defer os.Remove(name)
+    return syncFile(name)
+}
+
+// monitor probes roots and their free space periodically, degraded roots come back once they are writable again
+func (s *CacheServer) monitor() {
+    s.every(5 * time.Second, func() {
+        for _, r := range s.roots {
+            s.watch(r)
+            if err := r.probe(); err != nil { r.fail(err) } else {
+                if atomic.CompareAndSwapInt32(&r.degraded, 1, 0) { logger.Info("root recovered", zap.String("root", r.path)) }
+                if s.MinFree <= 0 && atomic.CompareAndSwapInt32(&r.full, 1, 0) { logger.Info("root writable", zap.String("root", r.path)) }
+            }
+        }
+    })
+}
+
+// rank orders roots by rendezvous score of uuid, the first one is where uuid belongs
+func rank(roots []*root, uuid string) []*root {
+    if len(roots) == 1 {return roots}
+    scores := make([]float64, len(roots))
+    ranked := make([]*root, len(roots))
+    for i, r := range roots {
+        h := fnv.New64a()
+        h.Write([]byte(r.path))
+        h.Write([]byte(uuid))
+        u := (float64(h.Sum64() >> 11) + 0.5) / (1 << 53)
+        scores[i] = -r.weight / math.Log(u)
+        ranked[i] = r
+    }
+    sort.Sort(&ranking{roots: ranked, scores: scores})
+    return ranked
+}
+
+type ranking struct {
+    roots  []*root
+    scores []float64
+}
+
+func (r *ranking) Len() int { return len(r.roots) }
+func (r *ranking) Less(i, j int) bool { return r.scores[i] > r.scores[j] }
+func (r *ranking) Swap(i, j int) {
+    r.roots[i], r.roots[j] = r.roots[j], r.roots[i]
+    r.scores[i], r.scores[j] = r.scores[j], r.scores[i]
+}
+
+// place returns the writable hot root for new entry of uuid, or nil when every hot root is degraded
+func (s *CacheServer) place(uuid string) *root {
+    return s.placeIn(s.hot, uuid)
+}
+
+func (s *CacheServer) placeIn(roots []*root, uuid string) *root {
+    for _, r := range rank(roots, uuid) {
+        if !r.readonly() {return r}
+    }
+    return nil
+}
+
+// locate finds which root stores entry, hot tier first, entries missing from every index are looked up on disk of the first hot root
+func (s *CacheServer) locate(version string, uuid string, t int) (*root, Meta, bool) {
+    ranked := rank(s.hot, uuid)
+    for _, tier := range [][]*root{ranked, rank(s.cold, uuid)} {
+        for _, r := range tier {
+            if m, ok := r.index.get(version, uuid, t); ok {return r, m, true}
+        }
+    }
+    return ranked[0], Meta{Version: version, Uuid: uuid, Type: t}, false
+}
+
+func mkdir(dir string) error {
+    if _, err := os.Stat(dir); err != nil && os.IsNotExist(err) { return os.MkdirAll(dir, 0700) }
+    return nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+    "encoding/hex"
+    "go.uber.org/zap"
+    "io"
+    "math/rand"
+    "os"
+    "path"
+    "sync/atomic"
+    "time"
+)
+
+type tierStats struct {
+    hot      int64
+    cold     int64
+    promoted int64
+    migrated int64
+}
+
+// migrate moves entries not accessed within MigrateAfter from hot roots to cold roots
+func (s *CacheServer) migrate() {
+    if len(s.cold) == 0 || s.MigrateAfter <= 0 {return}
+    interval := s.MigrateInterval
+    if interval <= 0 { interval = time.Minute }
+    s.every(interval, func() {
+        ts := time.Now()
+        moved, size := 0, int64(0)
+        for _, r := range s.hot {
+            for _, m := range r.index.list("") {
+                if s.stopping() {return}
+                if ts.Sub(time.Unix(0, m.Accessed)) < s.MigrateAfter {continue}
+                dst := s.placeIn(s.cold, m.Uuid)
+                if dst == nil {break}
+                if err := s.move(r, dst, &m); err != nil {
+                    logger.Error("migrate", zap.String("src", r.entry(&m)), zap.String("dst", dst.path), zap.Error(err))
+                    continue
+                }
+                moved++
+                size += m.Disk()
+                atomic.AddInt64(&s.tierStats.migrated, 1)
+            }
+        }
+        if moved > 0 { logger.Info("migrate", zap.Int("files", moved), zap.Int64("size", size), zap.Duration("elapse", time.Since(ts))) }
+    })
+}
+
+// promote moves an entry back to hot tier after it was served from cold tier
+func (s *CacheServer) promote(r *root, version string, uuid string, t int) {
+    key := metaKey(version, uuid, t)
+    if _, busy := s.promoting.LoadOrStore(key, r); busy {return}
+    defer s.promoting.Delete(key)
+    m, ok := r.index.get(version, uuid, t)
+    if !ok {return}
+    dst := s.placeIn(s.hot, uuid)
+    if dst == nil {return}
+    if err := s.move(r, dst, &m); err != nil {
+        logger.Error("promote", zap.String("src", r.entry(&m)), zap.String("dst", dst.path), zap.Error(err))
+        return
+    }
+    atomic.AddInt64(&s.tierStats.promoted, 1)
+    logger.Debug("promote", zap.String("file", dst.entry(&m)))
+}
+
+// move copies entry from src root into dst root, committing it removes the source copy
+func (s *CacheServer) move(src *root, dst *root, m *Meta) error {
+    in, err := os.Open(src.entry(m))
+    if err != nil {return err}
+    defer in.Close()
+    if err := dst.mktemp(); err != nil {dst.fail(err);return err}
+    name := make([]byte, 32)
+    rand.Read(name)
+    temp := path.Join(dst.temp, hex.EncodeToString(name))
+    out, err := os.OpenFile(temp, os.O_CREATE | os.O_WRONLY, 0700)
+    if err != nil {dst.fail(err);return err}
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        os.Remove(temp)
+        return err
+    }
+    out.Close()
+
+    filename := dst.entry(m)
+    if current, ok := src.index.get(m.Version, m.Uuid, m.Type); !ok || current.Created != m.Created {
+        os.Remove(temp)
+        return os.ErrNotExist /* replaced or removed while copying */
+    }
+    meta := *m
+    return s.commit(dst, temp, filename, &meta)
+}
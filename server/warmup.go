@@ -0,0 +1,104 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "go.uber.org/zap"
+    "io"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+type warmStats struct {
+    files int64
+    size  int64
+    done  int64
+}
+
+func (s *CacheServer) hotName() string { return path.Join(s.hot[0].path, "hot.log") }
+
+// persist writes hot keys of memory cache, replacing previous list atomically
+func (s *CacheServer) persist() error {
+    if !mcache.core.enabled() {return nil}
+    keys := mcache.core.hot()
+    name := s.hotName()
+    temp := name + ".tmp"
+    file, err := os.OpenFile(temp, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0700)
+    if err != nil {return err}
+    w := bufio.NewWriter(file)
+    enc := json.NewEncoder(w)
+    for i := range keys {
+        if err := enc.Encode(&keys[i]); err != nil {file.Close();return err}
+    }
+    if err := w.Flush(); err != nil {file.Close();return err}
+    if err := file.Close(); err != nil {return err}
+    logger.Debug("persist hot keys", zap.String("name", name), zap.Int("keys", len(keys)))
+    return os.Rename(temp, name)
+}
+
+// keep persists hot keys every WarmInterval
+func (s *CacheServer) keep() {
+    if s.WarmInterval <= 0 {return}
+    s.every(s.WarmInterval, func() {
+        if err := s.persist(); err != nil { logger.Error("persist hot keys", zap.Error(err)) }
+    })
+}
+
+// warm preloads entries of persisted hot keys into memory cache hottest first, reading no faster than WarmRate bytes per second
+func (s *CacheServer) warm() {
+    defer atomic.StoreInt64(&s.warmStats.done, 1)
+    if !mcache.core.enabled() {return}
+    file, err := os.Open(s.hotName())
+    if err != nil {return}
+    defer file.Close()
+    ts := time.Now()
+    capacity := atomic.LoadInt64(&mcache.core.capacity)
+    loaded := int64(0)
+    dec := json.NewDecoder(bufio.NewReader(file))
+    for loaded < capacity && !s.stopping() {
+        var k hotKey
+        if err := dec.Decode(&k); err != nil {
+            if err != io.EOF { logger.Warn("warm decode", zap.Error(err)) }
+            break
+        }
+        version, uuid, t, ok := parseKey(k.Key)
+        if !ok {continue}
+        r, m, ok := s.locate(version, uuid, t)
+        if !ok {continue}
+        a := s.admission(t)
+        size := m.Disk()
+        if size < a.Min || size >= a.Max || loaded + size > capacity {continue}
+        in, err := os.Open(r.entry(&m))
+        if err != nil {continue}
+        b := make([]byte, size)
+        _, err = io.ReadFull(in, b)
+        in.Close()
+        if err != nil {continue}
+        if !mcache.core.preload(k.Key, bytes.NewBuffer(b), k.Hits) {continue}
+        loaded += size
+        atomic.AddInt64(&s.warmStats.files, 1)
+        atomic.AddInt64(&s.warmStats.size, size)
+        if s.WarmRate > 0 {
+            if expect := time.Duration(loaded * int64(time.Second) / s.WarmRate); expect > time.Since(ts) {
+                time.Sleep(expect - time.Since(ts))
+            }
+        }
+    }
+    logger.Info("warm up", zap.Int64("files", atomic.LoadInt64(&s.warmStats.files)), zap.Int64("size", loaded), zap.Duration("elapse", time.Since(ts)))
+}
+
+// parseKey splits cache key version/uuid/type, version itself may contain slashes
+func parseKey(key string) (string, string, int, bool) {
+    i := strings.LastIndex(key, "/")
+    if i <= 0 {return "", "", 0, false}
+    t, err := strconv.Atoi(key[i+1:])
+    if err != nil {return "", "", 0, false}
+    j := strings.LastIndex(key[:i], "/")
+    if j <= 0 || i - j - 1 != 64 {return "", "", 0, false}
+    return key[:j], key[j+1:i], t, true
+}
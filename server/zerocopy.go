@@ -0,0 +1,35 @@
+package server
+
+import (
+    "hash"
+    "io"
+    "os"
+)
+
+// sendFile copies size bytes of file to w, a TCP connection lets kernel do it with sendfile
+func sendFile(w io.Writer, file *os.File, size int64) (int64, error) {
+    n, err := io.Copy(w, io.LimitReader(file, size))
+    if err == nil && n < size { err = io.ErrUnexpectedEOF }
+    return n, err
+}
+
+// receiveFile copies size bytes from r into file without staging them in connection buffers,
+// go releases that implement File.ReadFrom with splice let kernel move them from a TCP connection
+func receiveFile(file *os.File, r io.Reader, size int64) (int64, error) {
+    n, err := file.ReadFrom(io.LimitReader(r, size))
+    if err == nil && n < size { err = io.ErrUnexpectedEOF }
+    return n, err
+}
+
+// hashBack feeds n bytes written into file at off to h, which are still in page cache right after being received
+func hashBack(h hash.Hash, file *os.File, off int64, n int64, buf []byte) error {
+    for n > 0 {
+        num := int64(len(buf))
+        if n < num { num = n }
+        if _, err := file.ReadAt(buf[:num], off); err != nil {return err}
+        h.Write(buf[:num])
+        off += num
+        n -= num
+    }
+    return nil
+}